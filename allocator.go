@@ -0,0 +1,336 @@
+package lipid
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+//how free clusters are picked for new chains
+type AllocPolicy int
+
+const (
+	NextFit           AllocPolicy = iota //continue after the last allocation, wrapping around at the end of the volume
+	FirstFit                             //lowest free clusters first
+	BestFitContiguous                    //smallest free run that holds the whole chain, largest runs first if none does
+)
+
+func (p AllocPolicy) String() string {
+	switch p {
+	case NextFit:
+		return "next-fit"
+	case FirstFit:
+		return "first-fit"
+	case BestFitContiguous:
+		return "best-fit-contiguous"
+	}
+	return "unknown policy " + strconv.Itoa(int(p))
+}
+
+//free cluster bitmap, built when the image is opened and kept up to date by setFatEntry
+type allocator struct {
+	policy    AllocPolicy
+	free      []uint64 //one bit per cluster, set if the cluster is free
+	freeCount int64
+	cursor    int64 //where next-fit starts looking
+}
+
+//run of consecutive clusters
+type clusterRun struct {
+	start  int64
+	length int64
+}
+
+//choose how clusters are picked for new files and directories
+func (f *fat16) SetAllocPolicy(policy AllocPolicy) error {
+	if policy < NextFit || policy > BestFitContiguous {
+		return errors.New(policy.String())
+	}
+	f.alloc.policy = policy
+	return nil
+}
+
+//build the free bitmap from the cached FAT
+func (f *fat16) buildFreeMap() {
+	maxCluster := f.maxCluster()
+	f.alloc.free = make([]uint64, maxCluster/64+1)
+	f.alloc.freeCount = 0
+	for c := int64(2); c <= maxCluster; c++ {
+		if f.getFatEntry(c) == fat16Free {
+			f.markFree(c, true)
+		}
+	}
+	if f.alloc.cursor < 2 {
+		f.alloc.cursor = 2
+	}
+}
+
+//update the bitmap bit of a cluster
+func (f *fat16) markFree(cluster int64, free bool) {
+	if cluster < 2 || cluster > f.maxCluster() {
+		return
+	}
+	mask := uint64(1) << uint(cluster%64)
+	if (f.alloc.free[cluster/64]&mask != 0) == free {
+		return
+	}
+	if free {
+		f.alloc.free[cluster/64] |= mask
+		f.alloc.freeCount++
+	} else {
+		f.alloc.free[cluster/64] &^= mask
+		f.alloc.freeCount--
+	}
+}
+
+func (f *fat16) isFree(cluster int64) bool {
+	if cluster < 2 || cluster > f.maxCluster() {
+		return false
+	}
+	return f.alloc.free[cluster/64]&(uint64(1)<<uint(cluster%64)) != 0
+}
+
+//first free cluster between from and to, -1 if there is none
+func (f *fat16) nextFree(from int64, to int64) int64 {
+	if from < 2 {
+		from = 2
+	}
+	for from <= to {
+		word := f.alloc.free[from/64] >> uint(from%64)
+		if word == 0 {
+			//skip to the next word
+			from = (from/64 + 1) * 64
+			continue
+		}
+		c := from + int64(bits.TrailingZeros64(word))
+		if c > to {
+			return -1
+		}
+		return c
+	}
+	return -1
+}
+
+//number of free clusters starting at cluster, at most limit
+func (f *fat16) freeRunLength(cluster int64, limit int64) int64 {
+	n := int64(0)
+	for n < limit && f.isFree(cluster+n) {
+		n++
+	}
+	return n
+}
+
+//every free run on the volume in cluster order
+func (f *fat16) freeRuns() []clusterRun {
+	maxCluster := f.maxCluster()
+	runs := make([]clusterRun, 0)
+	for c := f.nextFree(2, maxCluster); c != -1; c = f.nextFree(c, maxCluster) {
+		length := f.freeRunLength(c, maxCluster-c+1)
+		runs = append(runs, clusterRun{c, length})
+		c += length
+	}
+	return runs
+}
+
+//pick free runs holding n clusters without changing anything
+func (f *fat16) findRuns(n int64) ([]clusterRun, error) {
+	if n > f.alloc.freeCount {
+		return nil, errors.New("not enough free space for " + strconv.FormatInt(n, 10) + " clusters")
+	}
+
+	var runs []clusterRun
+	switch f.alloc.policy {
+	case FirstFit:
+		runs = f.fitFrom(2, n)
+	case BestFitContiguous:
+		runs = f.bestFit(n)
+	default:
+		runs = f.fitFrom(f.alloc.cursor, n)
+	}
+
+	found := int64(0)
+	for _, r := range runs {
+		found += r.length
+	}
+	if found != n {
+		return nil, errors.New("free cluster bitmap is out of step with the FAT")
+	}
+	return runs, nil
+}
+
+//take whole free runs in cluster order starting at from, wrapping around to the start of the volume
+func (f *fat16) fitFrom(from int64, n int64) []clusterRun {
+	maxCluster := f.maxCluster()
+	runs := make([]clusterRun, 0)
+	end := maxCluster
+	for c := from; n > 0; {
+		c = f.nextFree(c, end)
+		if c == -1 {
+			if end != maxCluster || from <= 2 {
+				break
+			}
+			//wrap around, stopping short of where this search started
+			c, end = 2, from-1
+			continue
+		}
+		length := f.freeRunLength(c, end-c+1)
+		if length > n {
+			length = n
+		}
+		runs = append(runs, clusterRun{c, length})
+		n -= length
+		c += length
+	}
+	return runs
+}
+
+//smallest free run holding n clusters, lowest first on a tie; failing that the largest runs in cluster order
+func (f *fat16) bestFit(n int64) []clusterRun {
+	free := f.freeRuns()
+	best := -1
+	for i, r := range free {
+		if r.length >= n && (best == -1 || r.length < free[best].length) {
+			best = i
+		}
+	}
+	if best != -1 {
+		return []clusterRun{{free[best].start, n}}
+	}
+
+	//no single run is big enough, use as few runs as possible
+	sort.SliceStable(free, func(i, j int) bool { return free[i].length > free[j].length })
+	runs := make([]clusterRun, 0)
+	for _, r := range free {
+		if n == 0 {
+			break
+		}
+		if r.length > n {
+			r.length = n
+		}
+		runs = append(runs, r)
+		n -= r.length
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].start < runs[j].start })
+	return runs
+}
+
+//what a new chain has to look like
+type allocRequest struct {
+	clusters     int64
+	contiguous   bool  //the chain has to be a single run
+	firstCluster int64 //the run has to start here, 0 to let the allocator choose
+}
+
+//allocate a chain following the allocation policy, linked and ended in the FAT
+func (f *fat16) allocChain(req allocRequest) ([]int64, error) {
+	n := req.clusters
+	if n < 1 {
+		return nil, errors.New("cannot allocate " + strconv.FormatInt(n, 10) + " clusters")
+	}
+
+	var runs []clusterRun
+	var err error
+	switch {
+	case req.firstCluster != 0:
+		runs, err = f.findRunAt(req.firstCluster, n, req.contiguous)
+	case req.contiguous:
+		runs, err = f.findContiguous(n)
+	default:
+		runs, err = f.findRuns(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.takeRuns(runs), nil
+}
+
+//a chain of n clusters starting at first, the rest going wherever the policy puts it unless contiguous is set
+func (f *fat16) findRunAt(first int64, n int64, contiguous bool) ([]clusterRun, error) {
+	if first < 2 || first > f.maxCluster() {
+		return nil, errors.New("cluster " + strconv.FormatInt(first, 10) + " is outside the volume")
+	}
+	length := f.freeRunLength(first, n)
+	if length == 0 {
+		return nil, errors.New("cluster " + strconv.FormatInt(first, 10) + " is not free")
+	}
+	if length == n {
+		return []clusterRun{{first, n}}, nil
+	}
+	if contiguous {
+		return nil, errors.New("clusters " + strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(first+n-1, 10) + " are not all free")
+	}
+
+	//the clusters already taken must not be picked again
+	f.markTaken(first, length, true)
+	rest, err := f.findRuns(n - length)
+	f.markTaken(first, length, false)
+	if err != nil {
+		return nil, err
+	}
+	return append([]clusterRun{{first, length}}, rest...), nil
+}
+
+//temporarily hide a run from the bitmap, or give it back
+func (f *fat16) markTaken(start int64, length int64, taken bool) {
+	for c := start; c < start+length; c++ {
+		f.markFree(c, !taken)
+	}
+}
+
+//a single free run of n clusters, picked following the allocation policy
+func (f *fat16) findContiguous(n int64) ([]clusterRun, error) {
+	free := f.freeRuns()
+	pick := -1
+	for i, r := range free {
+		if r.length < n {
+			continue
+		}
+		switch f.alloc.policy {
+		case FirstFit:
+			if pick == -1 {
+				pick = i
+			}
+		case BestFitContiguous:
+			if pick == -1 || r.length < free[pick].length {
+				pick = i
+			}
+		default:
+			//first run after the cursor, the lowest run if there is none
+			if pick == -1 || (free[pick].start < f.alloc.cursor && r.start >= f.alloc.cursor) {
+				pick = i
+			}
+		}
+	}
+	if pick == -1 {
+		return nil, errors.New("no run of " + strconv.FormatInt(n, 10) + " contiguous free clusters")
+	}
+	return []clusterRun{{free[pick].start, n}}, nil
+}
+
+//link runs into one chain in the FAT and move the next-fit cursor past the last one
+func (f *fat16) takeRuns(runs []clusterRun) []int64 {
+	chain := make([]int64, 0)
+	for _, r := range runs {
+		for c := r.start; c < r.start+r.length; c++ {
+			chain = append(chain, c)
+		}
+	}
+	for i := 1; i < len(chain); i++ {
+		f.setFatEntry(chain[i-1], chain[i])
+	}
+	f.setFatEntry(chain[len(chain)-1], 0xFFFF)
+
+	f.alloc.cursor = chain[len(chain)-1] + 1
+	if f.alloc.cursor > f.maxCluster() {
+		f.alloc.cursor = 2
+	}
+	return chain
+}
+
+//mark every cluster of a chain as free
+func (f *fat16) freeChain(chain []int64) {
+	for _, c := range chain {
+		f.setFatEntry(c, fat16Free)
+	}
+}
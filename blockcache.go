@@ -0,0 +1,314 @@
+package lipid
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+//settings for the block cache between a volume and its image file
+type BlockCacheOptions struct {
+	Blocks    int   //number of blocks kept in memory, 0 disables the cache
+	BlockSize int64 //bytes per block, a multiple of the sector size, 0 uses the sector size
+	ReadAhead int   //extra blocks read when a miss follows the previous block
+}
+
+//suggested settings for OpenFat16ImageWithCache
+var DefaultBlockCacheOptions = BlockCacheOptions{
+	Blocks:    4096,
+	BlockSize: 0,
+	ReadAhead: 32,
+}
+
+//block cache hit statistics
+type CacheStats struct {
+	Hits            int64
+	Misses          int64
+	ReadAheadBlocks int64 //blocks loaded ahead of being asked for
+	Evictions       int64
+	BlocksWritten   int64
+	WriteCalls      int64 //writes to the image file, consecutive blocks go out in one call
+}
+
+//what a block holds, dirty blocks are written in this order
+const (
+	blockData = iota
+	blockDir
+	blockFat
+)
+
+type cacheBlock struct {
+	n     int64
+	data  []byte
+	dirty bool
+	kind  int
+}
+
+//write-back LRU cache of fixed size blocks in front of an image file
+type blockCache struct {
+	file      *os.File
+	size      int64 //size of the image file
+	blockSize int64
+	capacity  int
+	readAhead int
+	blocks    map[int64]*list.Element
+	lru       *list.List //most recently used at the front
+	pos       int64
+	lastBlock int64
+	kindOf    func(offset int64) int
+	stats     CacheStats
+}
+
+func newBlockCache(file *os.File, opts BlockCacheOptions, kindOf func(offset int64) int) (*blockCache, error) {
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &blockCache{
+		file:      file,
+		size:      stats.Size(),
+		blockSize: opts.BlockSize,
+		capacity:  opts.Blocks,
+		readAhead: opts.ReadAhead,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+		lastBlock: -2,
+		kindOf:    kindOf,
+	}, nil
+}
+
+func (c *blockCache) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return c.pos, errors.New("invalid whence " + strconv.Itoa(whence))
+	}
+	if offset < 0 {
+		return c.pos, errors.New("negative seek position")
+	}
+	c.pos = offset
+	return c.pos, nil
+}
+
+func (c *blockCache) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.size-c.pos {
+		p = p[:c.size-c.pos]
+	}
+	n, err := c.readAt(p, c.pos)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *blockCache) Write(p []byte) (int, error) {
+	n, err := c.writeAt(p, c.pos, -1)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *blockCache) readAt(p []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(p) {
+		n := (offset + int64(done)) / c.blockSize
+		within := (offset + int64(done)) % c.blockSize
+		b, err := c.get(n, true)
+		if err != nil {
+			return done, err
+		}
+		done += copy(p[done:], b.data[within:])
+	}
+	return done, nil
+}
+
+//write p at offset, kind -1 classifies blocks by their offset
+func (c *blockCache) writeAt(p []byte, offset int64, kind int) (int, error) {
+	done := 0
+	for done < len(p) {
+		n := (offset + int64(done)) / c.blockSize
+		within := (offset + int64(done)) % c.blockSize
+		//blocks that are overwritten completely do not need to be read first
+		whole := within == 0 && int64(len(p)-done) >= c.blockSize
+		b, err := c.get(n, !whole)
+		if err != nil {
+			return done, err
+		}
+		done += copy(b.data[within:], p[done:])
+		b.dirty = true
+		if kind != -1 {
+			b.kind = kind
+		}
+	}
+	if offset+int64(len(p)) > c.size {
+		c.size = offset + int64(len(p))
+	}
+	return done, nil
+}
+
+//get block n, loading it from the image if load is set
+func (c *blockCache) get(n int64, load bool) (*cacheBlock, error) {
+	if e, ok := c.blocks[n]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(e)
+		c.lastBlock = n
+		return e.Value.(*cacheBlock), nil
+	}
+	c.stats.Misses++
+
+	//read ahead when access is sequential
+	count := int64(1)
+	if load && n == c.lastBlock+1 {
+		for count <= int64(c.readAhead) && (n+count)*c.blockSize < c.size {
+			if _, ok := c.blocks[n+count]; ok {
+				break
+			}
+			count++
+		}
+	}
+	c.lastBlock = n
+
+	data := make([]byte, count*c.blockSize)
+	if load {
+		_, err := c.file.ReadAt(data, n*c.blockSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	for i := count - 1; i >= 0; i-- {
+		b := &cacheBlock{n: n + i, data: data[i*c.blockSize : (i+1)*c.blockSize], kind: c.kindOf((n + i) * c.blockSize)}
+		c.blocks[n+i] = c.lru.PushFront(b)
+	}
+	c.stats.ReadAheadBlocks += count - 1
+
+	err := c.evict()
+	if err != nil {
+		return nil, err
+	}
+	return c.blocks[n].Value.(*cacheBlock), nil
+}
+
+//drop least recently used blocks until the cache fits, writing everything first if one is dirty
+func (c *blockCache) evict() error {
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		b := e.Value.(*cacheBlock)
+		if b.dirty {
+			//write in order rather than letting a single block overtake the rest
+			err := c.writeBack(false)
+			if err != nil {
+				return err
+			}
+		}
+		c.lru.Remove(e)
+		delete(c.blocks, b.n)
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+//write every dirty block: data first, then directory entries, then FATs
+func (c *blockCache) writeBack(sync bool) error {
+	for _, kind := range []int{blockData, blockDir, blockFat} {
+		dirty := make([]*cacheBlock, 0)
+		for _, e := range c.blocks {
+			b := e.Value.(*cacheBlock)
+			if b.dirty && b.kind == kind {
+				dirty = append(dirty, b)
+			}
+		}
+		if len(dirty) == 0 {
+			continue
+		}
+		sort.Slice(dirty, func(i, j int) bool { return dirty[i].n < dirty[j].n })
+
+		//coalesce runs of consecutive blocks into one write
+		for i := 0; i < len(dirty); {
+			j := i + 1
+			for j < len(dirty) && dirty[j].n == dirty[j-1].n+1 {
+				j++
+			}
+			run := make([]byte, 0, int64(j-i)*c.blockSize)
+			for _, b := range dirty[i:j] {
+				run = append(run, b.data...)
+			}
+			offset := dirty[i].n * c.blockSize
+			//never grow the image past what was written to it
+			if offset+int64(len(run)) > c.size {
+				run = run[:c.size-offset]
+			}
+			_, err := c.file.WriteAt(run, offset)
+			if err != nil {
+				return err
+			}
+			c.stats.WriteCalls++
+			c.stats.BlocksWritten += int64(j - i)
+			for _, b := range dirty[i:j] {
+				b.dirty = false
+			}
+			i = j
+		}
+		if sync {
+			err := c.file.Sync()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//drop every block and take the image file to be size bytes, dirty blocks must have been written back
+func (c *blockCache) reset(size int64) {
+	c.blocks = make(map[int64]*list.Element)
+	c.lru.Init()
+	c.size = size
+	c.lastBlock = -2
+}
+
+//what a block at offset holds, judged by region
+func (f *fat16) blockKind(offset int64) int {
+	switch {
+	case offset < f.RegionOffsets.RootDirRegion.Offset:
+		return blockFat
+	case offset < f.RegionOffsets.DataRegion.Offset:
+		return blockDir
+	}
+	return blockData
+}
+
+//write directory entry bytes, flushed after data and before the FATs
+func (f *fat16) writeEntryBytes(bytes []byte, offset int64) error {
+	if c, ok := f.dev.(*blockCache); ok {
+		_, err := c.writeAt(bytes, offset, blockDir)
+		return err
+	}
+	return writeBytes(f.dev, bytes, offset)
+}
+
+//write every pending change to the image file in a safe order: data, then directory entries, then FATs
+func (f *fat16) Sync() error {
+	err := f.Flush()
+	if err != nil {
+		return err
+	}
+	if c, ok := f.dev.(*blockCache); ok {
+		return c.writeBack(true)
+	}
+	return f.File.Sync()
+}
+
+//block cache hit statistics, all zero if the cache is disabled
+func (f *fat16) CacheStats() CacheStats {
+	if c, ok := f.dev.(*blockCache); ok {
+		return c.stats
+	}
+	return CacheStats{}
+}
@@ -0,0 +1,75 @@
+package lipid
+
+import (
+	"strings"
+)
+
+//boot sector fields, parsed once when the image is opened
+type BootParameterBlock struct {
+	OSName            string
+	BytesPerSector    uint16
+	SectorsPerCluster uint8
+	ReservedSectors   uint16
+	FatCopies         uint8
+	RootEntries       uint16
+	SmallSectors      uint16
+	MediaDescriptor   uint8
+	SectorsPerFat     uint16
+	SectorsPerTrack   uint16
+	NumberOfHeads     uint16
+	HiddenSectors     uint32
+	LargeSectors      uint32
+	DriveNumber       uint8
+	ExtBootSig        uint8
+	VolumeSerialNum   uint32 //only valid when ExtBootSig is 0x29
+	VolumeLabel       string //only valid when ExtBootSig is 0x29
+	FileSystemType    string //only valid when ExtBootSig is 0x29
+	BootSectorSig     uint16
+}
+
+//parse a boot sector
+func parseBootSector(b []byte) BootParameterBlock {
+	value := func(o offsetObject) int64 {
+		temp := append([]byte(nil), b[o.Offset:o.Offset+o.Length]...)
+		swapEndianness(&temp)
+		return btoi64(&temp)
+	}
+	text := func(o offsetObject) string {
+		return strings.TrimRight(string(b[o.Offset:o.Offset+o.Length]), " \x00")
+	}
+
+	return BootParameterBlock{
+		OSName:            text(BootSector.OSName),
+		BytesPerSector:    uint16(value(BootSector.BytesPerSector)),
+		SectorsPerCluster: uint8(value(BootSector.SectorsPerCluster)),
+		ReservedSectors:   uint16(value(BootSector.ReservedSectors)),
+		FatCopies:         uint8(value(BootSector.FatCopies)),
+		RootEntries:       uint16(value(BootSector.RootEntries)),
+		SmallSectors:      uint16(value(BootSector.SmallSectors)),
+		MediaDescriptor:   uint8(value(BootSector.MediaDescriptor)),
+		SectorsPerFat:     uint16(value(BootSector.SectorsPerFat)),
+		SectorsPerTrack:   uint16(value(BootSector.SectorsPerTrack)),
+		NumberOfHeads:     uint16(value(BootSector.NumberOfHeads)),
+		HiddenSectors:     uint32(value(BootSector.HiddenSectors)),
+		LargeSectors:      uint32(value(BootSector.LargeSectors)),
+		DriveNumber:       uint8(value(BootSector.DriveNumber)),
+		ExtBootSig:        uint8(value(BootSector.ExtBootSig)),
+		VolumeSerialNum:   uint32(value(BootSector.VolumeSerialNum)),
+		VolumeLabel:       text(BootSector.VolumeLabel),
+		FileSystemType:    text(BootSector.FileSystemType),
+		BootSectorSig:     uint16(value(BootSector.BootSectorSig)),
+	}
+}
+
+//number of sectors in the volume
+func (b BootParameterBlock) TotalSectors() int64 {
+	if b.SmallSectors != 0 {
+		return int64(b.SmallSectors)
+	}
+	return int64(b.LargeSectors)
+}
+
+//number of bytes in a cluster
+func (b BootParameterBlock) BytesPerCluster() int64 {
+	return int64(b.BytesPerSector) * int64(b.SectorsPerCluster)
+}
@@ -0,0 +1,273 @@
+package lipid
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//what BuildImage puts in the image and how much room it leaves
+type BuildOptions struct {
+	Type         FatType  //FAT type to build, 0 for FAT16; MakeFat16 only formats FAT16 so any other type is refused
+	Label        string   //volume label, empty for none
+	SlackPercent int64    //free space to leave, as a percentage of the space the content takes
+	SlackBytes   int64    //free space to leave on top of SlackPercent
+	Include      []string //only files matching one of these are added, all files if empty
+	Exclude      []string //files and directories matching one of these are left out, even if included
+	Reproducible bool     //build in reproducible mode, see SetReproducible; modification times are not carried over
+}
+
+//a file or directory going into a built image
+type buildItem struct {
+	path    string //slash separated path inside fsys
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+//create a FAT16 image at imgPath holding the host directory hostDir, see BuildImage
+func BuildImageFromDir(imgPath string, hostDir string, opts BuildOptions) (*Fat16, error) {
+	info, err := os.Stat(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(hostDir + " is not a directory")
+	}
+	return BuildImage(imgPath, os.DirFS(hostDir), opts)
+}
+
+//create a FAT16 image at imgPath just big enough for everything in fsys plus the slack in opts, and open it;
+//modification times are carried over, symlinks to files are followed and anything else that is not a regular file or directory is skipped.
+//Patterns are matched against slash separated paths relative to the top of fsys with '**' matching any number of directories,
+//a pattern without a '/' is matched against the name alone. The cluster size is picked by PlanLayout, the FAT type is opts.Type,
+//which can only be FAT16 for now: content needing more than 65524 clusters of 32KB is refused and small content still gets 4085 clusters
+func BuildImage(imgPath string, fsys fs.FS, opts BuildOptions) (*Fat16, error) {
+	if opts.Type == 0 {
+		opts.Type = FAT16
+	}
+	if opts.Type != FAT16 {
+		return nil, errors.New("BuildOptions.Type is " + opts.Type.String() + ", BuildImage can only build FAT16 images")
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, errors.New("bad pattern " + pattern + ": " + err.Error())
+		}
+	}
+	if opts.SlackPercent < 0 || opts.SlackBytes < 0 {
+		return nil, errors.New("slack cannot be negative")
+	}
+
+	items, err := collectBuildItems(fsys, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBuildNames(items)
+	if err != nil {
+		return nil, err
+	}
+	args := DefaultFat16Args
+	if opts.Label != "" {
+		args.VolumeLabel = opts.Label
+	}
+	args.Reproducible = opts.Reproducible
+	totalSectors, args, err := planBuild(items, args, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := MakeFat16(imgPath, totalSectors*int64(args.BytesPerSector), args)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		err := f.addBuildItem(fsys, item)
+		if err != nil {
+			//do not leave a half built image behind
+			f.Close()
+			os.Remove(imgPath)
+			return nil, errors.New("adding " + item.path + ": " + err.Error())
+		}
+	}
+	return f, nil
+}
+
+//everything in fsys that goes into the image, each directory before what it holds and in lexical order, so entries go in sorted
+func collectBuildItems(fsys fs.FS, opts BuildOptions) ([]buildItem, error) {
+	items := make([]buildItem, 0)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		if matchesAny(opts.Exclude, p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := fs.Stat(fsys, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			items = append(items, buildItem{path: p, dir: true, modTime: info.ModTime()})
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchesAny(opts.Include, p) {
+			return nil
+		}
+		if info.Size() > 0xFFFFFFFF {
+			return errors.New(p + " is larger than 4GB, which is unsupported by FAT")
+		}
+		items = append(items, buildItem{path: p, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil || len(opts.Include) == 0 {
+		return items, err
+	}
+
+	//with include patterns only directories leading to an included file are kept
+	keep := make(map[string]bool)
+	for _, item := range items {
+		if !item.dir {
+			for p := path.Dir(item.path); p != "."; p = path.Dir(p) {
+				keep[p] = true
+			}
+		}
+	}
+	kept := make([]buildItem, 0, len(items))
+	for _, item := range items {
+		if !item.dir || keep[item.path] {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+//refuse names that only differ in case before anything is formatted, FAT cannot hold both in one directory
+func checkBuildNames(items []buildItem) error {
+	seen := make(map[string]string)
+	for _, item := range items {
+		key := strings.ToLower(item.path)
+		if other, ok := seen[key]; ok {
+			return errors.New(other + " and " + item.path + " only differ in case, which FAT does not tell apart")
+		}
+		seen[key] = item.path
+	}
+	return nil
+}
+
+//image size in sectors and format arguments for the smallest volume of type opts.Type holding items plus the slack in opts
+func planBuild(items []buildItem, args fatArgs, opts BuildOptions) (int64, fatArgs, error) {
+	entries := make([]PlanEntry, len(items))
+	for i, item := range items {
+		entries[i] = PlanEntry{Path: item.path, Dir: item.dir, Size: item.size}
+	}
+	layout, err := PlanLayout(entries, PlanOptions{
+		Types:          []FatType{opts.Type},
+		BytesPerSector: args.BytesPerSector,
+		RootEntries:    args.NumberOfRootEntries,
+		Label:          args.VolumeLabel != "" && args.VolumeLabel != "NO NAME",
+		SlackPercent:   opts.SlackPercent,
+		SlackBytes:     opts.SlackBytes,
+	})
+	if err != nil {
+		return 0, args, err
+	}
+	args.SectorsPerCluster = layout.Args.SectorsPerCluster
+	args.ReservedSectors = layout.Args.ReservedSectors
+	args.NumberOfRootEntries = layout.Args.NumberOfRootEntries
+	args.SectorsPerFat = layout.Args.SectorsPerFat
+	return layout.TotalSectors, args, nil
+}
+
+//add a single file or directory from fsys to the image under the same path
+func (f *fat16) addBuildItem(fsys fs.FS, item buildItem) error {
+	imgPath := "/" + item.path
+	if item.dir {
+		err := f.MakeDir(imgPath)
+		if err != nil {
+			return err
+		}
+		entry, err := f.lookup(imgPath)
+		if err != nil {
+			return err
+		}
+		return f.setBuildModified(entry.Offset, item.modTime)
+	}
+
+	in, err := fsys.Open(item.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	offset, chain, err := f.makeChainEntry(imgPath, allocRequest{clusters: f.clustersFor(item.size)})
+	if err != nil {
+		return err
+	}
+	err = f.setEntrySize(offset, item.size)
+	if err != nil {
+		return err
+	}
+	err = f.writeChainData(in, item.size, chain)
+	if err != nil {
+		return err
+	}
+	return f.setBuildModified(offset, item.modTime)
+}
+
+//carry a modification time over from the source, unless building reproducibly
+func (f *fat16) setBuildModified(offset int64, t time.Time) error {
+	if f.reproducible {
+		return nil
+	}
+	return f.setEntryModified(offset, t)
+}
+
+//true if p matches one of patterns
+func matchesAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+			continue
+		}
+		if matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(p, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+//match path segments against pattern segments, '**' matching any number of segments
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -1,12 +1,12 @@
 package lipid
 
-import "os"
+import "io"
 
-func getValue(file *os.File, offObj offsetObject) int64 {
+func getValue(file io.ReadSeeker, offObj offsetObject) int64 {
 	temp, _ := readBytes(file, offObj.Offset, offObj.Length, true)
 	return btoi64(&temp)
 }
-func readBytes(file *os.File, offset int64, numBytes int64, swapEndian bool) ([]byte, error) {
+func readBytes(file io.ReadSeeker, offset int64, numBytes int64, swapEndian bool) ([]byte, error) {
 	byteBuff := make([]byte, numBytes)
 	_, err := file.Seek(offset, 0)
 	if err != nil {
@@ -44,7 +44,7 @@ func btoi64(b *[]byte) int64 {
 	return r
 }
 
-func writeBytes(file *os.File, bytes []byte, offset int64) error {
+func writeBytes(file io.WriteSeeker, bytes []byte, offset int64) error {
 	_, err := file.Seek(offset, 0)
 	if err != nil {
 		return err
@@ -0,0 +1,112 @@
+package lipid
+
+import (
+	"fmt"
+)
+
+//special FAT16 values
+const (
+	fat16Free       int64 = 0x0000
+	fat16Bad        int64 = 0xFFF7
+	fat16EndOfChain int64 = 0xFFF8 //this and every value above it ends a chain
+)
+
+//true if a FAT value ends a chain
+func isEndOfChain(value int64) bool {
+	return value >= fat16EndOfChain
+}
+
+//walks a cluster chain, stopping with ErrCorrupt on loops, free clusters and links outside the volume
+type chainIterator struct {
+	f          *fat16
+	start      int64
+	cluster    int64 //current cluster, 0 before the first call to Next
+	length     int64 //clusters visited so far
+	maxCluster int64
+	visited    map[int64]bool
+	done       bool
+	err        error
+}
+
+//iterate over the chain starting at cluster start, a start of 0 is an empty chain
+func (f *fat16) newChainIterator(start int64) *chainIterator {
+	return &chainIterator{
+		f:          f,
+		start:      start,
+		maxCluster: f.maxCluster(),
+		visited:    make(map[int64]bool),
+	}
+}
+
+//highest valid cluster number
+func (f *fat16) maxCluster() int64 {
+	return f.RegionOffsets.DataRegion.Length/f.CommonSizes.BytesPerCluster + 1
+}
+
+//move to the next cluster, returns false at the end of the chain or on error
+func (c *chainIterator) Next() bool {
+	if c.done {
+		return false
+	}
+
+	var next int64
+	if c.cluster == 0 {
+		next = c.start
+		if next == 0 {
+			c.done = true
+			return false
+		}
+	} else {
+		next = c.f.getFatEntry(c.cluster)
+		if isEndOfChain(next) {
+			c.done = true
+			return false
+		}
+	}
+
+	switch {
+	case next == fat16Free:
+		c.fail(fmt.Errorf("%w: cluster %d links to a free cluster", ErrCorrupt, c.cluster))
+		return false
+	case next == fat16Bad:
+		c.fail(fmt.Errorf("%w: cluster %d links to a bad cluster", ErrCorrupt, c.cluster))
+		return false
+	case next < 2 || next > c.maxCluster:
+		c.fail(fmt.Errorf("%w: chain starting at cluster %d links to cluster %d, outside the volume", ErrCorrupt, c.start, next))
+		return false
+	case c.visited[next]:
+		c.fail(fmt.Errorf("%w: chain starting at cluster %d loops back to cluster %d", ErrCorrupt, c.start, next))
+		return false
+	}
+
+	//a chain can never hold more clusters than the volume
+	c.length++
+	if c.length > c.maxCluster-1 {
+		c.fail(fmt.Errorf("%w: chain starting at cluster %d is longer than the volume", ErrCorrupt, c.start))
+		return false
+	}
+	c.visited[next] = true
+	c.cluster = next
+	return true
+}
+
+func (c *chainIterator) fail(err error) {
+	c.err = err
+	c.done = true
+}
+
+//current cluster
+func (c *chainIterator) Cluster() int64 { return c.cluster }
+
+//error that stopped the walk, nil if the chain ended cleanly
+func (c *chainIterator) Err() error { return c.err }
+
+//get every cluster in the chain starting at cluster start
+func (f *fat16) getChain(start int64) ([]int64, error) {
+	chain := make([]int64, 0)
+	it := f.newChainIterator(start)
+	for it.Next() {
+		chain = append(chain, it.Cluster())
+	}
+	return chain, it.Err()
+}
@@ -0,0 +1,480 @@
+package lipid
+
+import (
+	"strconv"
+	"strings"
+)
+
+//kind of inconsistency found by Check
+type CheckProblem int
+
+const (
+	ProblemLostChain      CheckProblem = iota //allocated clusters not reachable from any entry
+	ProblemCrossLink                          //cluster claimed by more than one entry
+	ProblemShortChain                         //chain holds fewer clusters than the file size needs
+	ProblemLongChain                          //chain holds more clusters than the file size needs
+	ProblemChainLoop                          //chain links back into itself
+	ProblemInvalidCluster                     //entry or chain link points outside the data region
+	ProblemFreeCluster                        //entry or chain link points to a free cluster
+	ProblemOrphanedLfn                        //LFN entries not followed by a matching short entry
+	ProblemLfnChecksum                        //LFN checksum does not match its short entry
+	ProblemBadDotEntry                        //missing or wrong '.' or '..' entry
+	ProblemFatMismatch                        //FAT copies disagree
+)
+
+var checkProblemNames = []string{
+	"lost chain",
+	"cross-linked cluster",
+	"chain too short",
+	"chain too long",
+	"chain loop",
+	"invalid cluster",
+	"free cluster in use",
+	"orphaned LFN",
+	"LFN checksum mismatch",
+	"bad dot entry",
+	"FAT mismatch",
+}
+
+func (p CheckProblem) String() string {
+	if int(p) < 0 || int(p) >= len(checkProblemNames) {
+		return "unknown problem " + strconv.Itoa(int(p))
+	}
+	return checkProblemNames[p]
+}
+
+//a single inconsistency found by Check
+type CheckFinding struct {
+	Problem CheckProblem
+	Path    string //path of the affected entry, "" for FAT level findings
+	Offset  int64  //offset of the affected directory entry, -1 if none
+	Cluster int64  //first cluster involved, 0 if none
+	Count   int64  //number of clusters or entries involved
+	Detail  string
+}
+
+func (c CheckFinding) String() string {
+	s := c.Problem.String()
+	if c.Path != "" {
+		s += " at " + c.Path
+	}
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+//result of a filesystem check
+type CheckReport struct {
+	Findings     []CheckFinding
+	Files        int64 //regular files visited
+	Directories  int64 //directories visited, not counting the root
+	ClusterCount int64 //clusters in the data region
+	UsedClusters int64 //clusters owned by a file or directory
+	LostClusters int64 //allocated clusters not owned by anything
+}
+
+//true when no problems were found
+func (r *CheckReport) OK() bool { return len(r.Findings) == 0 }
+
+func (r *CheckReport) String() string {
+	if r.OK() {
+		return "no problems found"
+	}
+	lines := make([]string, 0, len(r.Findings))
+	for _, c := range r.Findings {
+		lines = append(lines, c.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+//directory entry visited during a check
+type checkEntry struct {
+	Path   string
+	Offset int64   //offset of the short entry
+	Slots  []int64 //offsets of the LFN entries and the short entry
+	IsDir  bool
+	Size   int64
+	Start  int64
+	Chain  []int64 //usable part of the cluster chain
+	Parent int64   //starting cluster of the parent directory, 0 for root
+}
+
+//slot offsets of an LFN run and why it is bad
+type lfnRun struct {
+	Problem CheckProblem
+	Slots   []int64
+}
+
+//working state of a check, shared with Repair
+type checkState struct {
+	report    *CheckReport
+	fats      [][]uint16 //every FAT copy
+	fat       []uint16   //FAT copy chains are followed in
+	owner     []int      //index+1 into entries of the owner of each cluster
+	entries   []checkEntry
+	badLfn    []lfnRun //LFN runs that belong to no short entry
+	lost      []bool   //allocated clusters nobody owns
+	lostHeads []int64  //first cluster of every lost chain
+
+	maxCluster      int64
+	bytesPerCluster int64
+}
+
+//walk the directory tree and FATs and report every inconsistency found
+func (f *fat16) Check() (*CheckReport, error) {
+	s, err := f.scan(0)
+	if err != nil {
+		return nil, err
+	}
+	return s.report, nil
+}
+
+//build the check state, following chains in FAT copy fatN
+func (f *fat16) scan(fatN int) (*checkState, error) {
+	clusterCount := f.RegionOffsets.DataRegion.Length / f.CommonSizes.BytesPerCluster
+	s := &checkState{
+		report:          &CheckReport{ClusterCount: clusterCount},
+		maxCluster:      clusterCount + 1,
+		bytesPerCluster: f.CommonSizes.BytesPerCluster,
+	}
+
+	//load every FAT copy
+	numberOfFats := int64(f.BPB.FatCopies)
+	for i := int64(0); i < numberOfFats; i++ {
+		table, err := f.readFatCopy(i)
+		if err != nil {
+			return nil, err
+		}
+		s.fats = append(s.fats, table)
+	}
+	if fatN < 0 || fatN >= len(s.fats) {
+		fatN = 0
+	}
+	s.fat = s.fats[fatN]
+
+	//compare copies against the one being used
+	for i, table := range s.fats {
+		if i == fatN {
+			continue
+		}
+		differing := int64(0)
+		first := int64(-1)
+		for j := range table {
+			if table[j] != s.fat[j] {
+				if first == -1 {
+					first = int64(j)
+				}
+				differing++
+			}
+		}
+		if differing > 0 {
+			s.add(CheckFinding{ProblemFatMismatch, "", -1, first, differing,
+				"FAT " + strconv.Itoa(i) + " differs from FAT " + strconv.Itoa(fatN) + " in " + strconv.FormatInt(differing, 10) + " entries"})
+		}
+	}
+
+	s.owner = make([]int, s.maxCluster+1)
+	err := f.checkDir(s, "", 0, 0, []offsetObject{f.RegionOffsets.RootDirRegion})
+	if err != nil {
+		return nil, err
+	}
+	s.findLostChains()
+
+	return s, nil
+}
+
+func (s *checkState) add(c CheckFinding) {
+	s.report.Findings = append(s.report.Findings, c)
+}
+
+//classify a FAT value: 0 free, 1 next cluster, 2 end of chain, 3 bad, -1 invalid
+func (s *checkState) linkType(value int64) int {
+	switch {
+	case value == fat16Free:
+		return 0
+	case value >= 2 && value <= s.maxCluster:
+		return 1
+	case isEndOfChain(value):
+		return 2
+	case value == fat16Bad:
+		return 3
+	}
+	return -1
+}
+
+//check every entry in a directory made of the given regions
+func (f *fat16) checkDir(s *checkState, path string, dirCluster int64, parentCluster int64, regions []offsetObject) error {
+	//read the whole directory
+	offsets := make([]int64, 0)
+	data := make([]byte, 0)
+	for _, r := range regions {
+		b, err := readBytes(f.dev, r.Offset, r.Length, false)
+		if err != nil {
+			return err
+		}
+		data = append(data, b...)
+		for i := int64(0); i < r.Length; i += 32 {
+			offsets = append(offsets, r.Offset+i)
+		}
+	}
+
+	//pending LFN run
+	lfnStart := -1
+	lfnNext := byte(0)
+	lfnSum := byte(0)
+	orphan := func(end int) {
+		if lfnStart == -1 {
+			return
+		}
+		s.add(CheckFinding{ProblemOrphanedLfn, path + "/", offsets[lfnStart], 0, int64(end - lfnStart),
+			strconv.Itoa(end-lfnStart) + " LFN entries without a short entry"})
+		s.badLfn = append(s.badLfn, lfnRun{ProblemOrphanedLfn, offsets[lfnStart:end]})
+		lfnStart = -1
+	}
+
+	for n := 0; n < len(offsets); n++ {
+		e := data[n*32 : n*32+32]
+		if e[0] == 0x00 {
+			//end of directory
+			orphan(n)
+			break
+		}
+		if e[0] == 0xE5 {
+			orphan(n)
+			continue
+		}
+
+		if e[0x0B] == 0x0F {
+			ordinal := e[0] & 0x3F
+			if e[0]&0x40 == 0x40 {
+				//start of a new run
+				orphan(n)
+				lfnStart = n
+				lfnNext = ordinal - 1
+				lfnSum = e[0x0D]
+			} else if lfnStart != -1 && ordinal == lfnNext && e[0x0D] == lfnSum {
+				lfnNext--
+			} else {
+				orphan(n)
+				s.add(CheckFinding{ProblemOrphanedLfn, path + "/", offsets[n], 0, 1, "LFN entry out of sequence"})
+				s.badLfn = append(s.badLfn, lfnRun{ProblemOrphanedLfn, offsets[n : n+1]})
+			}
+			continue
+		}
+
+		//volume label
+		if e[0x0B]&0x08 == 0x08 {
+			orphan(n)
+			continue
+		}
+
+		entryStart := n
+		if lfnStart != -1 {
+			if lfnNext != 0 {
+				orphan(n)
+			} else {
+				if generateLfnChecksum(string(e[:11])) != lfnSum {
+					s.add(CheckFinding{ProblemLfnChecksum, path + "/" + f.readName(offsets[n]), offsets[lfnStart], 0, int64(n - lfnStart),
+						"LFN checksum does not match short name"})
+					s.badLfn = append(s.badLfn, lfnRun{ProblemLfnChecksum, offsets[lfnStart:n]})
+				} else {
+					entryStart = lfnStart
+				}
+				lfnStart = -1
+			}
+		}
+
+		name := f.readName(offsets[entryStart])
+		start := int64(e[0x1A]) | int64(e[0x1B])<<8
+		isDir := e[0x0B]&0x10 == 0x10
+
+		//dot entries
+		if name == "." || name == ".." {
+			want := dirCluster
+			if name == ".." {
+				want = parentCluster
+			}
+			position := 0
+			if name == ".." {
+				position = 1
+			}
+			if dirCluster == 0 {
+				s.add(CheckFinding{ProblemBadDotEntry, path + "/" + name, offsets[n], start, 1, "dot entry in root directory"})
+			} else if n != position || !isDir || start != want {
+				s.add(CheckFinding{ProblemBadDotEntry, path + "/" + name, offsets[n], start, 1,
+					"expected directory at slot " + strconv.Itoa(position) + " pointing to cluster " + strconv.FormatInt(want, 10)})
+			}
+			continue
+		}
+		if dirCluster != 0 && n < 2 {
+			dotName := "."
+			if n == 1 {
+				dotName = ".."
+			}
+			s.add(CheckFinding{ProblemBadDotEntry, path + "/" + dotName, offsets[n], 0, 1, "missing " + dotName + " entry"})
+		}
+
+		entry := checkEntry{
+			Path:   path + "/" + name,
+			Offset: offsets[n],
+			Slots:  offsets[entryStart : n+1],
+			IsDir:  isDir,
+			Size:   int64(e[0x1C]) | int64(e[0x1D])<<8 | int64(e[0x1E])<<16 | int64(e[0x1F])<<24,
+			Start:  start,
+			Parent: dirCluster,
+		}
+		if isDir {
+			s.report.Directories++
+		} else {
+			s.report.Files++
+		}
+		index := len(s.entries)
+		s.entries = append(s.entries, entry)
+		s.followChain(index)
+
+		//descend into directories
+		entry = s.entries[index]
+		if isDir && len(entry.Chain) > 0 && s.owner[entry.Chain[0]] == index+1 {
+			childRegions := make([]offsetObject, 0, len(entry.Chain))
+			for _, c := range entry.Chain {
+				childRegions = append(childRegions, offsetObject{f.GetClusterOffset(c), f.CommonSizes.BytesPerCluster})
+			}
+			err := f.checkDir(s, entry.Path, entry.Start, dirCluster, childRegions)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	orphan(len(offsets))
+
+	//a subdirectory always holds '.' and '..'
+	if dirCluster != 0 && len(data) >= 64 && (data[0] == 0x00 || data[32] == 0x00) {
+		s.add(CheckFinding{ProblemBadDotEntry, path, regions[0].Offset, dirCluster, 1, "missing dot entries"})
+	}
+
+	return nil
+}
+
+//follow the chain of entry index, claiming clusters and recording problems
+func (s *checkState) followChain(index int) {
+	e := &s.entries[index]
+	if e.Start == 0 {
+		if e.IsDir {
+			s.add(CheckFinding{ProblemInvalidCluster, e.Path, e.Offset, 0, 0, "directory has no clusters"})
+		} else if e.Size > 0 {
+			s.add(CheckFinding{ProblemShortChain, e.Path, e.Offset, 0, 0,
+				"size is " + strconv.FormatInt(e.Size, 10) + " bytes but no clusters are allocated"})
+		}
+		return
+	}
+	if s.linkType(e.Start) != 1 {
+		s.add(CheckFinding{ProblemInvalidCluster, e.Path, e.Offset, e.Start, 0,
+			"starting cluster " + strconv.FormatInt(e.Start, 10) + " is outside the data region"})
+		return
+	}
+
+	chain := make([]int64, 0)
+	cluster := e.Start
+	broken := true
+	for {
+		if s.fat[cluster] == 0x0000 {
+			s.add(CheckFinding{ProblemFreeCluster, e.Path, e.Offset, cluster, int64(len(chain)),
+				"cluster " + strconv.FormatInt(cluster, 10) + " is marked free"})
+			break
+		}
+		if owner := s.owner[cluster]; owner != 0 {
+			if owner == index+1 {
+				s.add(CheckFinding{ProblemChainLoop, e.Path, e.Offset, cluster, int64(len(chain)),
+					"chain loops back to cluster " + strconv.FormatInt(cluster, 10)})
+			} else {
+				s.add(CheckFinding{ProblemCrossLink, e.Path, e.Offset, cluster, int64(len(chain)),
+					"cluster " + strconv.FormatInt(cluster, 10) + " is also used by " + s.entries[owner-1].Path})
+			}
+			break
+		}
+		s.owner[cluster] = index + 1
+		s.report.UsedClusters++
+		chain = append(chain, cluster)
+
+		next := int64(s.fat[cluster])
+		t := s.linkType(next)
+		if t == 1 {
+			cluster = next
+			continue
+		}
+		if t == 2 {
+			broken = false
+		} else {
+			s.add(CheckFinding{ProblemInvalidCluster, e.Path, e.Offset, cluster, int64(len(chain)),
+				"cluster " + strconv.FormatInt(cluster, 10) + " links to invalid value 0x" + strconv.FormatInt(next, 16)})
+		}
+		break
+	}
+	e.Chain = chain
+
+	//sizes are only compared against chains that ended cleanly
+	if e.IsDir || broken {
+		return
+	}
+	//files made by MakeEmptyFile own a single cluster with a size of 0
+	expected := (e.Size + s.bytesPerCluster - 1) / s.bytesPerCluster
+	if expected == 0 {
+		expected = 1
+	}
+	if int64(len(chain)) < expected {
+		s.add(CheckFinding{ProblemShortChain, e.Path, e.Offset, e.Start, int64(len(chain)),
+			strconv.Itoa(len(chain)) + " clusters allocated, " + strconv.FormatInt(expected, 10) + " needed for " + strconv.FormatInt(e.Size, 10) + " bytes"})
+	} else if int64(len(chain)) > expected {
+		s.add(CheckFinding{ProblemLongChain, e.Path, e.Offset, e.Start, int64(len(chain)),
+			strconv.Itoa(len(chain)) + " clusters allocated, " + strconv.FormatInt(expected, 10) + " needed for " + strconv.FormatInt(e.Size, 10) + " bytes"})
+	}
+}
+
+//group allocated clusters nobody owns into chains
+func (s *checkState) findLostChains() {
+	s.lost = make([]bool, s.maxCluster+1)
+	lost := s.lost
+	pointedTo := make([]bool, s.maxCluster+1)
+	for c := int64(2); c <= s.maxCluster; c++ {
+		value := int64(s.fat[c])
+		if s.owner[c] != 0 || value == 0x0000 || value == 0xFFF7 {
+			continue
+		}
+		lost[c] = true
+		s.report.LostClusters++
+	}
+	for c := int64(2); c <= s.maxCluster; c++ {
+		if next := int64(s.fat[c]); lost[c] && s.linkType(next) == 1 && lost[next] {
+			pointedTo[next] = true
+		}
+	}
+
+	//walk from every head, then from whatever is left (chains that only form loops)
+	visited := make([]bool, s.maxCluster+1)
+	walk := func(head int64) {
+		length := int64(0)
+		for c := head; lost[c] && !visited[c]; {
+			visited[c] = true
+			length++
+			next := int64(s.fat[c])
+			if s.linkType(next) != 1 {
+				break
+			}
+			c = next
+		}
+		s.lostHeads = append(s.lostHeads, head)
+		s.add(CheckFinding{ProblemLostChain, "", -1, head, length,
+			strconv.FormatInt(length, 10) + " lost clusters starting at cluster " + strconv.FormatInt(head, 10)})
+	}
+	for c := int64(2); c <= s.maxCluster; c++ {
+		if lost[c] && !pointedTo[c] && !visited[c] {
+			walk(c)
+		}
+	}
+	for c := int64(2); c <= s.maxCluster; c++ {
+		if lost[c] && !visited[c] {
+			walk(c)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package lipid
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//where a file or directory lives on the volume
+type EntryExtents struct {
+	Path    string
+	Dir     bool
+	Extents []Extent //in chain order, empty for an empty file
+}
+
+//free runs whose length falls between MinLength and MaxLength clusters
+type FreeRunBucket struct {
+	MinLength int64
+	MaxLength int64
+	Runs      int
+	Clusters  int64
+}
+
+//layout of every file and directory and of the free space on the volume
+type ClusterReport struct {
+	Entries               []EntryExtents
+	Stats                 FragmentationStats
+	AverageExtentsPerFile float64         //over files holding at least one cluster
+	FreeHistogram         []FreeRunBucket //free runs by length in powers of two, shortest first
+	TotalClusters         int64
+	FreeClusters          int64
+	BadClusters           int64
+	LostClusters          int64 //in use but not reached from any directory entry
+}
+
+//what a cluster holds, as drawn on a cluster map
+const (
+	clusterFree = iota
+	clusterFile
+	clusterDir
+	clusterFragmented
+	clusterLost
+	clusterBad
+)
+
+//characters drawn by ClusterMapASCII; a cell covering several clusters shows the kind furthest down this list it holds
+var clusterMapChars = []byte{'.', '#', 'D', 'F', '?', 'B'}
+
+//colors drawn by ClusterMapPNG, in the same order
+var clusterMapColors = []color.RGBA{
+	{0xE0, 0xE0, 0xE0, 0xFF}, //free
+	{0x30, 0x70, 0xD0, 0xFF}, //file
+	{0x30, 0xA0, 0x40, 0xFF}, //directory
+	{0xE0, 0x80, 0x20, 0xFF}, //fragmented file or directory
+	{0xA0, 0x40, 0xC0, 0xFF}, //lost
+	{0xD0, 0x20, 0x20, 0xFF}, //bad
+}
+
+//extents of every file and directory along with fragmentation and free space figures
+func (f *fat16) ClusterReport() (ClusterReport, error) {
+	nodes, err := f.defragTree()
+	if err != nil {
+		return ClusterReport{}, err
+	}
+	report := ClusterReport{
+		Entries:       make([]EntryExtents, 0, len(nodes)),
+		Stats:         f.fragmentation(nodes),
+		FreeHistogram: make([]FreeRunBucket, 0),
+		TotalClusters: f.maxCluster() - 1,
+		FreeClusters:  f.alloc.freeCount,
+	}
+
+	fileExtents, filesWithData := int64(0), int64(0)
+	for _, n := range nodes {
+		extents := f.chainExtents(n.chain)
+		report.Entries = append(report.Entries, EntryExtents{Path: n.path, Dir: n.dir, Extents: extents})
+		if !n.dir && len(extents) > 0 {
+			fileExtents += int64(len(extents))
+			filesWithData++
+		}
+	}
+	if filesWithData > 0 {
+		report.AverageExtentsPerFile = float64(fileExtents) / float64(filesWithData)
+	}
+
+	for _, r := range f.freeRuns() {
+		//bucket i holds runs of 2^i up to 2^(i+1)-1 clusters
+		i := 0
+		for int64(2)<<uint(i) <= r.length {
+			i++
+		}
+		for len(report.FreeHistogram) <= i {
+			min := int64(1) << uint(len(report.FreeHistogram))
+			report.FreeHistogram = append(report.FreeHistogram, FreeRunBucket{MinLength: min, MaxLength: min*2 - 1})
+		}
+		report.FreeHistogram[i].Runs++
+		report.FreeHistogram[i].Clusters += r.length
+	}
+
+	for _, kind := range f.clusterKinds(nodes)[2:] {
+		switch kind {
+		case clusterBad:
+			report.BadClusters++
+		case clusterLost:
+			report.LostClusters++
+		}
+	}
+	return report, nil
+}
+
+//text map of the volume, width cells to a line each covering clustersPerCell clusters, every line led by its first cluster number;
+//'.' free, '#' file, 'D' directory, 'F' fragmented file or directory, '?' lost, 'B' bad
+func (f *fat16) ClusterMapASCII(width int, clustersPerCell int64) (string, error) {
+	if width < 1 || clustersPerCell < 1 {
+		return "", errors.New("a cluster map needs at least one cell per line and one cluster per cell")
+	}
+	nodes, err := f.defragTree()
+	if err != nil {
+		return "", err
+	}
+	kinds := f.clusterKinds(nodes)
+	maxCluster := f.maxCluster()
+	digits := len(strconv.FormatInt(maxCluster, 10))
+
+	var b strings.Builder
+	for line := int64(2); line <= maxCluster; line += int64(width) * clustersPerCell {
+		number := strconv.FormatInt(line, 10)
+		b.WriteString(strings.Repeat(" ", digits-len(number)) + number + " ")
+		for cell := line; cell < line+int64(width)*clustersPerCell && cell <= maxCluster; cell += clustersPerCell {
+			kind := byte(clusterFree)
+			for c := cell; c < cell+clustersPerCell && c <= maxCluster; c++ {
+				if kinds[c] > kind {
+					kind = kinds[c]
+				}
+			}
+			b.WriteByte(clusterMapChars[kind])
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+//write a PNG map of the volume to w, one pixel per cluster and width clusters to a row, colored as in ClusterMapASCII:
+//light grey free, blue file, green directory, orange fragmented, purple lost, red bad
+func (f *fat16) ClusterMapPNG(w io.Writer, width int) error {
+	if width < 1 {
+		return errors.New("a cluster map needs at least one cluster per row")
+	}
+	nodes, err := f.defragTree()
+	if err != nil {
+		return err
+	}
+	kinds := f.clusterKinds(nodes)[2:]
+	height := (len(kinds) + width - 1) / width
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, kind := range kinds {
+		img.SetRGBA(i%width, i/width, clusterMapColors[kind])
+	}
+	return png.Encode(w, img)
+}
+
+//what every cluster of the volume holds, indexed by cluster number
+func (f *fat16) clusterKinds(nodes []*defragNode) []byte {
+	maxCluster := f.maxCluster()
+	kinds := make([]byte, maxCluster+1)
+	for c := int64(2); c <= maxCluster; c++ {
+		switch f.getFatEntry(c) {
+		case fat16Free:
+		case fat16Bad:
+			kinds[c] = clusterBad
+		default:
+			//reached from no entry until a chain below claims it
+			kinds[c] = clusterLost
+		}
+	}
+	for _, n := range nodes {
+		kind := byte(clusterFile)
+		if n.dir {
+			kind = clusterDir
+		}
+		if len(f.chainExtents(n.chain)) > 1 {
+			kind = clusterFragmented
+		}
+		for _, c := range n.chain {
+			if c <= maxCluster {
+				kinds[c] = kind
+			}
+		}
+	}
+	return kinds
+}
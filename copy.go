@@ -0,0 +1,182 @@
+package lipid
+
+import (
+	"errors"
+	"strconv"
+)
+
+//what a copy carries over besides the data
+type CopyOptions struct {
+	PreserveAttrs bool //copy the read-only, hidden, system and archive bits
+	PreserveTimes bool //copy the creation, access and write times instead of stamping the copy as new
+}
+
+//copy a file inside the image; if dst is a directory the copy goes in it under the same name
+func (f *fat16) Copy(src string, dst string) error {
+	return f.CopyWithOptions(src, dst, CopyOptions{})
+}
+
+//copy a file inside the image, carrying over what opts asks for
+func (f *fat16) CopyWithOptions(src string, dst string, opts CopyOptions) error {
+	entry, err := f.lookup(src)
+	if err != nil {
+		return err
+	}
+	if entry.IsDir() {
+		return errors.New(src + " is a directory")
+	}
+	return f.copyTree(entry, dst, opts)
+}
+
+//copy a file or a directory and everything under it inside the image; if dst is a directory the copy goes in it under the same name
+func (f *fat16) CopyTree(src string, dst string) error {
+	return f.CopyTreeWithOptions(src, dst, CopyOptions{})
+}
+
+//copy a file or a directory and everything under it inside the image, carrying over what opts asks for
+func (f *fat16) CopyTreeWithOptions(src string, dst string, opts CopyOptions) error {
+	entry, err := f.lookup(src)
+	if err != nil {
+		return err
+	}
+	if entry.Offset == -1 {
+		return errors.New("cannot copy the root directory")
+	}
+	return f.copyTree(entry, dst, opts)
+}
+
+func (f *fat16) copyTree(entry dirEntry, dst string, opts CopyOptions) error {
+	dstPath, err := f.copyTarget(entry.Name, dst)
+	if err != nil {
+		return err
+	}
+
+	//walk the whole source first, so a corrupt tree is caught before anything is written
+	entries := []dirEntry{entry}
+	err = f.collectTree(entry, &entries, make(map[int64]bool), make(map[int64]bool))
+	if err != nil {
+		return err
+	}
+	needed := int64(0)
+	dirs := make(map[int64]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs[e.Start] = true
+			needed++
+		} else {
+			needed += f.clustersFor(e.Size)
+		}
+	}
+	if entry.IsDir() {
+		parent, err := f.parentCluster(dstPath)
+		if err != nil {
+			return err
+		}
+		if dirs[parent] {
+			return errors.New("cannot copy " + entry.Name + " into itself")
+		}
+	}
+	if needed > f.alloc.freeCount {
+		return errors.New("not enough free space to copy " + entry.Name + ", " + strconv.FormatInt(needed, 10) + " clusters needed")
+	}
+
+	return f.copyEntry(entry, dstPath, opts)
+}
+
+//path a copy named name goes to: inside dst if it is a directory, dst itself if it does not exist
+func (f *fat16) copyTarget(name string, dst string) (string, error) {
+	entry, err := f.lookup(dst)
+	if errors.Is(err, ErrCorrupt) {
+		return "", err
+	}
+	if err != nil {
+		return dst, nil
+	}
+	if !entry.IsDir() {
+		return "", errors.New(dst + " already exists")
+	}
+	return joinPath(dst, name), nil
+}
+
+//copy a single entry to dstPath, and for a directory everything under it
+func (f *fat16) copyEntry(src dirEntry, dstPath string, opts CopyOptions) error {
+	if !src.IsDir() {
+		srcChain, err := f.getChain(src.Start)
+		if err != nil {
+			return err
+		}
+		offset, chain, err := f.makeChainEntry(dstPath, allocRequest{clusters: f.clustersFor(src.Size)})
+		if err != nil {
+			return err
+		}
+		//copy the clusters holding data, a copy of an empty file just gets a clean cluster
+		for i, c := range chain {
+			if i >= len(srcChain) || int64(i)*f.CommonSizes.BytesPerCluster >= src.Size {
+				err := f.clearCluster(c)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := readBytes(f.dev, f.GetClusterOffset(srcChain[i]), f.CommonSizes.BytesPerCluster, false)
+			if err != nil {
+				return err
+			}
+			err = writeBytes(f.dev, data, f.GetClusterOffset(c))
+			if err != nil {
+				return err
+			}
+		}
+		err = f.setEntrySize(offset, src.Size)
+		if err != nil {
+			return err
+		}
+		return f.copyMeta(src, offset, opts)
+	}
+
+	err := f.MakeDir(dstPath)
+	if err != nil {
+		return err
+	}
+	dir, err := f.lookup(dstPath)
+	if err != nil {
+		return err
+	}
+	err = f.copyMeta(src, dir.Offset, opts)
+	if err != nil {
+		return err
+	}
+	children, err := f.readDir(src.Start)
+	if err != nil {
+		return err
+	}
+	for _, e := range children {
+		if e.IsDot() {
+			continue
+		}
+		err := f.copyEntry(e, joinPath(dstPath, e.Name), opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//carry attributes and timestamps of src over to the short entry at offset as opts asks
+func (f *fat16) copyMeta(src dirEntry, offset int64, opts CopyOptions) error {
+	if !opts.PreserveAttrs && !opts.PreserveTimes {
+		return nil
+	}
+	raw, err := readBytes(f.dev, offset, 32, false)
+	if err != nil {
+		return err
+	}
+	if opts.PreserveAttrs {
+		raw[0x0B] = src.Attr&^AttrDirectory | raw[0x0B]&AttrDirectory
+	}
+	if opts.PreserveTimes {
+		copy(raw[0x0D:0x14], src.Raw[0x0D:0x14])
+		copy(raw[0x16:0x1A], src.Raw[0x16:0x1A])
+	}
+	return f.writeEntryBytes(raw[0x0B:0x1A], offset+0x0B)
+}
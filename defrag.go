@@ -0,0 +1,287 @@
+package lipid
+
+import (
+	"errors"
+	"sort"
+)
+
+//how Defrag rearranges the volume
+type DefragOptions struct {
+	Compact bool        //also move contiguous chains into the lowest free run that holds them, packing data toward the start
+	Stop    func() bool //checked before each chain is moved, returning true ends the run early
+}
+
+//how fragmented the volume is
+type FragmentationStats struct {
+	Files                 int
+	FragmentedFiles       int //files in more than one extent
+	Directories           int //not counting the root directory
+	FragmentedDirectories int
+	Extents               int64 //extents of every file and directory
+	FreeRuns              int
+	LargestFreeRun        int64 //clusters in the largest free run
+}
+
+//what a Defrag run did
+type DefragReport struct {
+	Before        FragmentationStats
+	After         FragmentationStats
+	ChainsMoved   int
+	ClustersMoved int64
+	Unmovable     int  //fragmented chains with no free run large enough to hold them
+	Stopped       bool //Stop ended the run early
+}
+
+//a file or directory whose chain Defrag may move, located by its place in its parent so it can be found after the parent moves
+type defragNode struct {
+	path      string
+	parent    *defragNode //nil for the root directory
+	pos       int64       //position of the short entry in the parent's directory data
+	dir       bool
+	chain     []int64 //nil for the root directory and empty files
+	children  []*defragNode
+	dotPos    int64 //position of the '.' entry in the directory's own data, -1 if it has none
+	dotDotPos int64 //position of the '..' entry, -1 if it has none
+}
+
+//rewrite fragmented chains into contiguous runs, and with opts.Compact pack them toward the start of the volume.
+//Each chain is copied to its new place and synced before the entries pointing at it are changed, and only then freed,
+//so an interrupted run leaves at worst lost clusters for Check to report, never a file pointing at the wrong data
+func (f *fat16) Defrag(opts DefragOptions) (DefragReport, error) {
+	report := DefragReport{}
+	nodes, err := f.defragTree()
+	if err != nil {
+		return report, err
+	}
+	report.Before = f.fragmentation(nodes)
+
+passes:
+	for {
+		movedThisPass := 0
+		report.Unmovable = 0
+		//lowest chains first, so later chains can fill the space they leave
+		order := append([]*defragNode(nil), nodes...)
+		sortNodes(order)
+		for _, n := range order {
+			if len(n.chain) == 0 {
+				continue
+			}
+			fragmented := len(f.chainExtents(n.chain)) > 1
+			if !fragmented && !opts.Compact {
+				continue
+			}
+			target := int64(-1)
+			for _, r := range f.freeRuns() {
+				if r.length >= int64(len(n.chain)) {
+					target = r.start
+					break
+				}
+			}
+			if target == -1 {
+				if fragmented {
+					report.Unmovable++
+				}
+				continue
+			}
+			if !fragmented && target > n.chain[0] {
+				continue
+			}
+			if opts.Stop != nil && opts.Stop() {
+				report.Stopped = true
+				break passes
+			}
+			err := f.moveChain(n, target)
+			if err != nil {
+				return report, errors.New("moving " + n.path + ": " + err.Error())
+			}
+			movedThisPass++
+			report.ChainsMoved++
+			report.ClustersMoved += int64(len(n.chain))
+		}
+		//moving a chain can open room further down, go again until nothing moves
+		if movedThisPass == 0 || !opts.Compact {
+			break
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return report, err
+	}
+	report.After = f.fragmentation(nodes)
+	return report, nil
+}
+
+//fragmentation of every file and directory on the volume
+func (f *fat16) Fragmentation() (FragmentationStats, error) {
+	nodes, err := f.defragTree()
+	if err != nil {
+		return FragmentationStats{}, err
+	}
+	return f.fragmentation(nodes), nil
+}
+
+func (f *fat16) fragmentation(nodes []*defragNode) FragmentationStats {
+	stats := FragmentationStats{}
+	for _, n := range nodes {
+		extents := len(f.chainExtents(n.chain))
+		stats.Extents += int64(extents)
+		if n.dir {
+			stats.Directories++
+			if extents > 1 {
+				stats.FragmentedDirectories++
+			}
+		} else {
+			stats.Files++
+			if extents > 1 {
+				stats.FragmentedFiles++
+			}
+		}
+	}
+	for _, r := range f.freeRuns() {
+		stats.FreeRuns++
+		if r.length > stats.LargestFreeRun {
+			stats.LargestFreeRun = r.length
+		}
+	}
+	return stats
+}
+
+//copy a chain to the contiguous free run at target, point everything at the copy and free the old chain
+func (f *fat16) moveChain(n *defragNode, target int64) error {
+	old := n.chain
+	//the current directory's entry may sit in this chain
+	current := int64(-1)
+	if n.dir {
+		current = n.position(f, f.CurrentDirOffset)
+	}
+	chain, err := f.allocChain(allocRequest{clusters: int64(len(old)), contiguous: true, firstCluster: target})
+	if err != nil {
+		return err
+	}
+	for i, c := range old {
+		data, err := readBytes(f.dev, f.GetClusterOffset(c), f.CommonSizes.BytesPerCluster, false)
+		if err != nil {
+			f.freeChain(chain)
+			return err
+		}
+		err = writeBytes(f.dev, data, f.GetClusterOffset(chain[i]))
+		if err != nil {
+			f.freeChain(chain)
+			return err
+		}
+	}
+	n.chain = chain
+	if n.dir && n.dotPos != -1 {
+		err := f.setEntryStart(n.dataOffset(f, n.dotPos), chain[0])
+		if err != nil {
+			return err
+		}
+	}
+	//the copy and its FAT entries are on disk before anything points at them
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = f.setEntryStart(n.parent.dataOffset(f, n.pos), chain[0])
+	if err != nil {
+		return err
+	}
+	for _, child := range n.children {
+		if child.dir && child.dotDotPos != -1 && len(child.chain) > 0 {
+			err := f.setEntryStart(child.dataOffset(f, child.dotDotPos), chain[0])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	if current != -1 {
+		f.CurrentDirOffset = n.dataOffset(f, current)
+	}
+	f.freeChain(old)
+	return nil
+}
+
+//offset in the image of position pos in a directory's data
+func (n *defragNode) dataOffset(f *fat16, pos int64) int64 {
+	if n.parent == nil {
+		return f.RegionOffsets.RootDirRegion.Offset + pos
+	}
+	return f.GetClusterOffset(n.chain[pos/f.CommonSizes.BytesPerCluster]) + pos%f.CommonSizes.BytesPerCluster
+}
+
+//position in a directory's data of the byte at offset
+func (n *defragNode) position(f *fat16, offset int64) int64 {
+	if n.parent == nil {
+		return offset - f.RegionOffsets.RootDirRegion.Offset
+	}
+	for i, c := range n.chain {
+		start := f.GetClusterOffset(c)
+		if offset >= start && offset < start+f.CommonSizes.BytesPerCluster {
+			return int64(i)*f.CommonSizes.BytesPerCluster + offset - start
+		}
+	}
+	return -1
+}
+
+//every file and directory under the root directory with its chain
+func (f *fat16) defragTree() ([]*defragNode, error) {
+	root := &defragNode{path: "/", dir: true, dotPos: -1, dotDotPos: -1}
+	nodes := make([]*defragNode, 0)
+	err := f.defragDir(root, 0, &nodes, make(map[int64]bool))
+	return nodes, err
+}
+
+func (f *fat16) defragDir(dir *defragNode, dirCluster int64, nodes *[]*defragNode, visited map[int64]bool) error {
+	err := checkDirLoop(visited, dirCluster)
+	if err != nil {
+		return err
+	}
+	entries, err := f.readDir(dirCluster)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch e.ShortName {
+		case ".":
+			dir.dotPos = dir.position(f, e.Offset)
+		case "..":
+			dir.dotDotPos = dir.position(f, e.Offset)
+		}
+		if e.IsDot() {
+			continue
+		}
+		n := &defragNode{path: joinPath(dir.path, e.Name), parent: dir, pos: dir.position(f, e.Offset), dir: e.IsDir(), dotPos: -1, dotDotPos: -1}
+		if e.Start != 0 {
+			n.chain, err = f.getChain(e.Start)
+			if err != nil {
+				return err
+			}
+		}
+		dir.children = append(dir.children, n)
+		*nodes = append(*nodes, n)
+		if n.dir && e.Start != 0 {
+			err := f.defragDir(n, e.Start, nodes, visited)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//order nodes by the first cluster of their chain
+func sortNodes(nodes []*defragNode) {
+	first := func(n *defragNode) int64 {
+		if len(n.chain) == 0 {
+			return 0
+		}
+		return n.chain[0]
+	}
+	sort.Slice(nodes, func(i, j int) bool { return first(nodes[i]) < first(nodes[j]) })
+}
@@ -0,0 +1,389 @@
+package lipid
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//a parsed directory entry
+type dirEntry struct {
+	Name      string  //long name if present, short name otherwise
+	ShortName string  //8.3 name as NAME.EXT
+	Offset    int64   //offset of the short entry, -1 for the root directory
+	Slots     []int64 //offsets of the LFN entries and the short entry
+	Attr      byte
+	Start     int64
+	Size      int64
+	Raw       []byte //the short entry
+	Deleted   bool
+}
+
+func (e dirEntry) IsDir() bool { return e.Attr&0x10 == 0x10 }
+
+//true for the '.' and '..' entries
+func (e dirEntry) IsDot() bool { return e.ShortName == "." || e.ShortName == ".." }
+
+//entry standing in for the root directory
+var rootDirEntry = dirEntry{Name: "/", ShortName: "/", Offset: -1, Attr: 0x10}
+
+//regions making up a directory, dirCluster 0 is the root directory
+func (f *fat16) dirRegions(dirCluster int64) ([]offsetObject, error) {
+	if dirCluster == 0 {
+		return []offsetObject{f.RegionOffsets.RootDirRegion}, nil
+	}
+	chain, err := f.getChain(dirCluster)
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]offsetObject, 0, len(chain))
+	for _, c := range chain {
+		regions = append(regions, offsetObject{f.GetClusterOffset(c), f.CommonSizes.BytesPerCluster})
+	}
+	return regions, nil
+}
+
+//read every live entry of a directory, dirCluster 0 is the root directory
+func (f *fat16) readDir(dirCluster int64) ([]dirEntry, error) {
+	return f.readDirEntries(dirCluster, false, false)
+}
+
+//read the entries of a directory, optionally along with deleted entries and volume labels
+func (f *fat16) readDirEntries(dirCluster int64, deleted bool, labels bool) ([]dirEntry, error) {
+	regions, err := f.dirRegions(dirCluster)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dirEntry, 0)
+	lfnSlots := make([]int64, 0)
+	lfnParts := make([][]byte, 0)
+	deletedSlots := make([]int64, 0)
+	deletedParts := make([][]byte, 0)
+	for _, r := range regions {
+		data, err := readBytes(f.dev, r.Offset, r.Length, false)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < r.Length; i += 32 {
+			e := data[i : i+32]
+			//end of directory
+			if e[0] == 0x00 {
+				return entries, nil
+			}
+			if e[0] == 0xE5 {
+				lfnSlots = lfnSlots[:0]
+				lfnParts = lfnParts[:0]
+				if !deleted {
+					continue
+				}
+				if e[0x0B] == 0x0F {
+					deletedSlots = append(deletedSlots, r.Offset+i)
+					deletedParts = append(deletedParts, e)
+					continue
+				}
+				entry := parseShortEntry(e, r.Offset+i)
+				entry.Deleted = true
+				if longName := decodeDeletedLfn(deletedParts); longName != "" {
+					entry.Name = longName
+					entry.Slots = append(append([]int64(nil), deletedSlots...), entry.Offset)
+				}
+				deletedSlots = deletedSlots[:0]
+				deletedParts = deletedParts[:0]
+				if entry.Attr&0x08 == 0x08 && !labels {
+					continue
+				}
+				entries = append(entries, entry)
+				continue
+			}
+			deletedSlots = deletedSlots[:0]
+			deletedParts = deletedParts[:0]
+			if e[0x0B] == 0x0F {
+				if e[0]&0x40 == 0x40 {
+					lfnSlots = lfnSlots[:0]
+					lfnParts = lfnParts[:0]
+				}
+				lfnSlots = append(lfnSlots, r.Offset+i)
+				lfnParts = append(lfnParts, e)
+				continue
+			}
+
+			entry := parseShortEntry(e, r.Offset+i)
+			if longName := decodeLfn(lfnParts, e); longName != "" {
+				entry.Name = longName
+				entry.Slots = append(append([]int64(nil), lfnSlots...), entry.Offset)
+			}
+			lfnSlots = lfnSlots[:0]
+			lfnParts = lfnParts[:0]
+
+			//volume label
+			if entry.Attr&0x08 == 0x08 && !labels {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+//parse a 32 byte short entry found at offset
+func parseShortEntry(e []byte, offset int64) dirEntry {
+	name := make([]byte, 0, 12)
+	for j := 0; j < 8; j++ {
+		//0x05 stands in for a leading 0xE5
+		if j == 0 && e[0] == 0x05 {
+			name = append(name, 0xE5)
+		} else if e[j] > 0x20 {
+			name = append(name, e[j])
+		}
+	}
+	ext := make([]byte, 0, 3)
+	for j := 8; j < 11; j++ {
+		if e[j] > 0x20 {
+			ext = append(ext, e[j])
+		}
+	}
+	//a deleted entry has lost its first character
+	if len(name) > 0 && e[0] == 0xE5 {
+		name[0] = '?'
+	}
+	shortName := string(name)
+	if len(ext) > 0 {
+		shortName += "." + string(ext)
+	}
+	//a volume label is a single 11 character name
+	if e[0x0B] != 0x0F && e[0x0B]&0x08 == 0x08 {
+		shortName = strings.TrimRight(string(e[:11]), " ")
+	}
+
+	return dirEntry{
+		Name:      shortName,
+		ShortName: shortName,
+		Offset:    offset,
+		Slots:     []int64{offset},
+		Attr:      e[0x0B],
+		Start:     int64(e[0x1A]) | int64(e[0x1B])<<8,
+		Size:      int64(e[0x1C]) | int64(e[0x1D])<<8 | int64(e[0x1E])<<16 | int64(e[0x1F])<<24,
+		Raw:       append([]byte(nil), e...),
+	}
+}
+
+//assemble a long name from its LFN entries (stored last part first), "" if they do not belong to short
+func decodeLfn(parts [][]byte, short []byte) string {
+	if len(parts) == 0 || parts[0][0]&0x40 != 0x40 || int(parts[0][0]&0x3F) != len(parts) {
+		return ""
+	}
+	cSum := generateLfnChecksum(string(short[:11]))
+	name := make([]rune, 0, len(parts)*13)
+	for i := len(parts) - 1; i >= 0; i-- {
+		p := parts[i]
+		if int(p[0]&0x3F) != len(parts)-i || p[0x0D] != cSum {
+			return ""
+		}
+		for _, o := range fat16UnicodeOffsets {
+			r := rune(p[o]) | rune(p[o+1])<<8
+			if r == 0x0000 || r == 0xFFFF {
+				break
+			}
+			name = append(name, r)
+		}
+	}
+	return string(name)
+}
+
+//assemble a long name from the LFN entries of a deleted entry, "" if they do not hang together
+func decodeDeletedLfn(parts [][]byte) string {
+	if len(parts) == 0 {
+		return ""
+	}
+	//the ordinals are gone, but every part still carries the checksum of the short entry
+	name := make([]rune, 0, len(parts)*13)
+	for i := len(parts) - 1; i >= 0; i-- {
+		p := parts[i]
+		if p[0x0D] != parts[0][0x0D] {
+			return ""
+		}
+		for _, o := range fat16UnicodeOffsets {
+			r := rune(p[o]) | rune(p[o+1])<<8
+			if r == 0x0000 || r == 0xFFFF {
+				break
+			}
+			name = append(name, r)
+		}
+	}
+	return string(name)
+}
+
+//starting cluster of the current directory, 0 for the root directory
+func (f *fat16) currentDirCluster() int64 {
+	if f.CurrentDirOffset == f.RegionOffsets.RootDirRegion.Offset {
+		return 0
+	}
+	return getValue(f.dev, offsetObject{f.CurrentDirOffset + 0x1A, 2})
+}
+
+//find the entry at path, names match either the long or the short name ignoring case
+func (f *fat16) lookup(path string) (dirEntry, error) {
+	entry := rootDirEntry
+	dirCluster := f.currentDirCluster()
+	if strings.HasPrefix(path, "/") {
+		dirCluster = 0
+	} else if dirCluster != 0 {
+		raw, err := readBytes(f.dev, f.CurrentDirOffset, 32, false)
+		if err != nil {
+			return dirEntry{}, err
+		}
+		entry = parseShortEntry(raw, f.CurrentDirOffset)
+	}
+
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." {
+			continue
+		}
+		if !entry.IsDir() {
+			return dirEntry{}, errors.New(path + " is not a valid path")
+		}
+		entries, err := f.readDir(dirCluster)
+		if err != nil {
+			return dirEntry{}, err
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name, p) || strings.EqualFold(e.ShortName, p) {
+				entry = e
+				found = true
+				break
+			}
+		}
+		if !found {
+			return dirEntry{}, errors.New(path + " is not a valid path")
+		}
+		//'..' pointing at cluster 0 leads back to the root directory
+		if entry.IsDot() && entry.Start == 0 {
+			entry = rootDirEntry
+		}
+		dirCluster = entry.Start
+	}
+	return entry, nil
+}
+
+//make sure a directory is not its own ancestor
+func checkDirLoop(visited map[int64]bool, dirCluster int64) error {
+	if visited[dirCluster] {
+		return fmt.Errorf("%w: directory at cluster %d contains itself", ErrCorrupt, dirCluster)
+	}
+	visited[dirCluster] = true
+	return nil
+}
+
+//write the size field of the short entry at offset
+func (f *fat16) setEntrySize(offset int64, size int64) error {
+	sizeBytes := []byte{byte(size & 0x000000FF), byte((size & 0x0000FF00) >> 8), byte((size & 0x00FF0000) >> 16), byte((size & 0xFF000000) >> 24)}
+	return f.writeEntryBytes(sizeBytes, offset+0x1C)
+}
+
+//write the starting cluster field of the short entry at offset
+func (f *fat16) setEntryStart(offset int64, cluster int64) error {
+	return f.writeEntryBytes([]byte{byte(cluster & 0x00FF), byte((cluster & 0xFF00) >> 8)}, offset+0x1A)
+}
+
+//write the last write time and date fields of the short entry at offset
+func (f *fat16) setEntryModified(offset int64, t time.Time) error {
+	date, clock := fatDateTime(t)
+	return f.writeEntryBytes([]byte{byte(clock & 0x00FF), byte((clock & 0xFF00) >> 8), byte(date & 0x00FF), byte((date & 0xFF00) >> 8)}, offset+0x16)
+}
+
+//starting cluster of the directory a new entry at path goes in, 0 for the root directory
+func (f *fat16) parentCluster(path string) (int64, error) {
+	i := strings.LastIndex(path, "/")
+	if i == -1 {
+		return f.currentDirCluster(), nil
+	}
+	if i == 0 {
+		return 0, nil
+	}
+	parent, err := f.lookup(path[:i])
+	if err != nil {
+		return -1, err
+	}
+	if !parent.IsDir() {
+		return -1, errors.New(path[:i] + " is not a directory")
+	}
+	return parent.Start, nil
+}
+
+//true if an entry in entries goes by name
+func nameTaken(entries []dirEntry, name string) bool {
+	for _, e := range entries {
+		if strings.EqualFold(e.Name, name) || strings.EqualFold(e.ShortName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//offsets of n consecutive free slots in a directory, growing it if there are none
+func (f *fat16) freeSlots(dirCluster int64, n int) ([]int64, error) {
+	regions, err := f.dirRegions(dirCluster)
+	if err != nil {
+		return nil, err
+	}
+	run := make([]int64, 0, n)
+	for _, r := range regions {
+		data, err := readBytes(f.dev, r.Offset, r.Length, false)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < r.Length; i += 32 {
+			if data[i] != 0x00 && data[i] != 0xE5 {
+				run = run[:0]
+				continue
+			}
+			run = append(run, r.Offset+i)
+			if len(run) == n {
+				return run, nil
+			}
+		}
+	}
+
+	//the root directory has a fixed size
+	if dirCluster == 0 {
+		return nil, errors.New("no space left in the root directory")
+	}
+	chain, err := f.getChain(dirCluster)
+	if err != nil {
+		return nil, err
+	}
+	slotsPerCluster := int(f.CommonSizes.BytesPerCluster / 32)
+	added, err := f.extendChain(chain, int64((n-len(run)+slotsPerCluster-1)/slotsPerCluster))
+	if err != nil {
+		return nil, err
+	}
+	//a free run at the end of the directory carries on into the new clusters
+	for _, c := range added {
+		err := f.clearCluster(c)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < slotsPerCluster && len(run) < n; i++ {
+			run = append(run, f.GetClusterOffset(c)+int64(i*32))
+		}
+	}
+	return run, nil
+}
+
+//point an entry at a new chain and size and mark it as written now, in a single write;
+//access date, write time and date, starting cluster and size sit next to each other, creation time and attributes are kept
+func (f *fat16) updateEntry(entry dirEntry, start int64, size int64) error {
+	fields := append([]byte(nil), entry.Raw...)
+	stampEntry(fields, f.now())
+	copy(fields[0x0D:0x12], entry.Raw[0x0D:0x12])
+	fields[0x1A] = byte(start & 0x00FF)
+	fields[0x1B] = byte((start & 0xFF00) >> 8)
+	fields[0x1C] = byte(size & 0x000000FF)
+	fields[0x1D] = byte((size & 0x0000FF00) >> 8)
+	fields[0x1E] = byte((size & 0x00FF0000) >> 16)
+	fields[0x1F] = byte((size & 0xFF000000) >> 24)
+	return f.writeEntryBytes(fields[0x12:], entry.Offset+0x12)
+}
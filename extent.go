@@ -0,0 +1,50 @@
+package lipid
+
+//run of physically consecutive clusters belonging to a file
+type Extent struct {
+	StartCluster int64
+	Clusters     int64
+	StartSector  int64 //first sector counted from the start of the image
+	Sectors      int64
+}
+
+//physical layout of the file or directory at path, in chain order
+func (f *fat16) Extents(path string) ([]Extent, error) {
+	entry, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	//the root directory lives outside the data region
+	if entry.Offset == -1 {
+		root := f.RegionOffsets.RootDirRegion
+		return []Extent{{
+			StartSector: root.Offset / f.CommonSizes.BytesPerSector,
+			Sectors:     root.Length / f.CommonSizes.BytesPerSector,
+		}}, nil
+	}
+	chain, err := f.getChain(entry.Start)
+	if err != nil {
+		return nil, err
+	}
+	return f.chainExtents(chain), nil
+}
+
+//group a chain into runs of consecutive clusters
+func (f *fat16) chainExtents(chain []int64) []Extent {
+	extents := make([]Extent, 0)
+	for i, c := range chain {
+		if i > 0 && c == chain[i-1]+1 {
+			last := &extents[len(extents)-1]
+			last.Clusters++
+			last.Sectors += f.CommonSizes.SectorsPerCluster
+			continue
+		}
+		extents = append(extents, Extent{
+			StartCluster: c,
+			Clusters:     1,
+			StartSector:  f.GetClusterOffset(c) / f.CommonSizes.BytesPerSector,
+			Sectors:      f.CommonSizes.SectorsPerCluster,
+		})
+	}
+	return extents
+}
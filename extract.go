@@ -0,0 +1,222 @@
+package lipid
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//what ExtractTree does when an entry lands on a host name that is taken, by another entry of the same directory
+//ignoring case or by a file or directory already on the host; files and directories follow the same rule
+type CollisionPolicy int
+
+const (
+	CollisionSkip      CollisionPolicy = iota //keep what holds the name first and report the others
+	CollisionRename                           //write the others under a name with a ~N suffix
+	CollisionOverwrite                        //let the last one win, a directory is merged into the one already there
+)
+
+//how ExtractTreeWithOptions writes to the host
+type ExtractOptions struct {
+	MapReadOnly bool //make files with the read-only attribute read-only on the host
+	Collisions  CollisionPolicy
+}
+
+//entry that could not be extracted
+type ExtractError struct {
+	Path string //path in the image
+	Err  error
+}
+
+func (e ExtractError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+//entry written under another host name to avoid a collision
+type ExtractRename struct {
+	Path     string //path in the image
+	HostPath string
+}
+
+//what ExtractTree did
+type ExtractReport struct {
+	Files       int64
+	Directories int64
+	Bytes       int64
+	Renamed     []ExtractRename
+	Errors      []ExtractError
+}
+
+//true if every entry was extracted
+func (r ExtractReport) OK() bool { return len(r.Errors) == 0 }
+
+//copy the file or directory tree at imgPath into hostDir, keeping last write times
+func (f *fat16) ExtractTree(imgPath string, hostDir string) (ExtractReport, error) {
+	return f.ExtractTreeWithOptions(imgPath, hostDir, ExtractOptions{})
+}
+
+//copy the file or directory tree at imgPath into hostDir; errors on single entries end up in the report and do not stop the extraction
+func (f *fat16) ExtractTreeWithOptions(imgPath string, hostDir string, opts ExtractOptions) (ExtractReport, error) {
+	report := ExtractReport{}
+	entry, err := f.lookup(imgPath)
+	if err != nil {
+		return report, err
+	}
+	err = os.MkdirAll(hostDir, 0755)
+	if err != nil {
+		return report, err
+	}
+
+	//the root directory itself is extracted into hostDir
+	if entry.Offset == -1 {
+		f.extractDir(&report, imgPath, entry, hostDir, opts, make(map[int64]bool))
+		return report, nil
+	}
+	err = checkHostName(entry.Name)
+	if err != nil {
+		report.Errors = append(report.Errors, ExtractError{imgPath, err})
+		return report, nil
+	}
+	name, ok := hostName(&report, imgPath, entry.Name, hostDir, make(map[string]bool), opts)
+	if ok {
+		f.extractEntry(&report, imgPath, entry, filepath.Join(hostDir, name), opts, make(map[int64]bool))
+	}
+	return report, nil
+}
+
+//write one entry to hostPath, a directory with everything under it
+func (f *fat16) extractEntry(report *ExtractReport, path string, entry dirEntry, hostPath string, opts ExtractOptions, visited map[int64]bool) {
+	info := entryInfo(path, entry)
+	if !entry.IsDir() {
+		mode := os.FileMode(0644)
+		if opts.MapReadOnly && entry.Attr&AttrReadOnly != 0 {
+			mode = 0444
+		}
+		//a read-only file left by an earlier run cannot be opened for writing
+		if opts.Collisions == CollisionOverwrite {
+			os.Chmod(hostPath, 0644)
+		}
+		//written as an ordinary file, the read-only mode is applied once the data is in
+		err := f.readEntry(path, entry, hostPath, 0644)
+		if err == nil {
+			err = os.Chmod(hostPath, mode)
+		}
+		if err == nil {
+			err = setHostTimes(hostPath, info)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, ExtractError{path, err})
+			return
+		}
+		report.Files++
+		report.Bytes += entry.Size
+		return
+	}
+
+	err := os.Mkdir(hostPath, 0755)
+	if err != nil && !(os.IsExist(err) && opts.Collisions == CollisionOverwrite) {
+		report.Errors = append(report.Errors, ExtractError{path, err})
+		return
+	}
+	report.Directories++
+	f.extractDir(report, path, entry, hostPath, opts, visited)
+	//times of a directory change as its contents are written, so they are set last
+	err = setHostTimes(hostPath, info)
+	if err != nil {
+		report.Errors = append(report.Errors, ExtractError{path, err})
+	}
+}
+
+//write the contents of a directory into hostDir
+func (f *fat16) extractDir(report *ExtractReport, path string, entry dirEntry, hostDir string, opts ExtractOptions, visited map[int64]bool) {
+	err := checkDirLoop(visited, entry.Start)
+	if err != nil {
+		report.Errors = append(report.Errors, ExtractError{path, err})
+		return
+	}
+	children, err := f.readDir(entry.Start)
+	if err != nil {
+		report.Errors = append(report.Errors, ExtractError{path, err})
+		return
+	}
+
+	//host names already handed out in this directory, folded to lower case
+	used := make(map[string]bool)
+	for _, e := range children {
+		if e.IsDot() {
+			continue
+		}
+		childPath := joinPath(path, e.Name)
+		err := checkHostName(e.Name)
+		if err != nil {
+			report.Errors = append(report.Errors, ExtractError{childPath, err})
+			continue
+		}
+		name, ok := hostName(report, childPath, e.Name, hostDir, used, opts)
+		if ok {
+			f.extractEntry(report, childPath, e, filepath.Join(hostDir, name), opts, visited)
+		}
+	}
+}
+
+//host name in hostDir for the entry at path, following the collision policy; false if the entry is skipped
+func hostName(report *ExtractReport, path string, name string, hostDir string, used map[string]bool, opts ExtractOptions) (string, bool) {
+	if opts.Collisions == CollisionOverwrite {
+		used[strings.ToLower(name)] = true
+		return name, true
+	}
+	//a case insensitive host finds an existing name in any case
+	onHost := func(n string) bool {
+		_, err := os.Lstat(filepath.Join(hostDir, n))
+		return err == nil
+	}
+	taken := func(n string) bool { return used[strings.ToLower(n)] || onHost(n) }
+	if taken(name) {
+		switch opts.Collisions {
+		case CollisionSkip:
+			reason := "host name collides with another entry"
+			if !used[strings.ToLower(name)] {
+				reason = filepath.Join(hostDir, name) + " already exists on the host"
+			}
+			report.Errors = append(report.Errors, ExtractError{path, errors.New(reason)})
+			return "", false
+		case CollisionRename:
+			name = collisionName(name, taken)
+			report.Renamed = append(report.Renamed, ExtractRename{path, filepath.Join(hostDir, name)})
+		}
+	}
+	used[strings.ToLower(name)] = true
+	return name, true
+}
+
+//refuse names that would lead outside the directory they are extracted into; the long name is read from the image unchecked
+func checkHostName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return errors.New("name " + strconv.Quote(name) + " cannot be used on the host")
+	}
+	return nil
+}
+
+//first name of the form base~N.ext not taken yet
+func collisionName(name string, taken func(string) bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := base + "~" + strconv.Itoa(n) + ext
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+//apply the FAT last write time, and the last access date, to a host file
+func setHostTimes(hostPath string, info EntryInfo) error {
+	if info.Modified.IsZero() {
+		return nil
+	}
+	accessed := info.Accessed
+	if accessed.IsZero() {
+		accessed = info.Modified
+	}
+	return os.Chtimes(hostPath, accessed, info.Modified)
+}
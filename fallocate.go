@@ -0,0 +1,142 @@
+package lipid
+
+import (
+	"errors"
+	"strconv"
+)
+
+//how FallocateWithOptions treats the reserved space
+type FallocateOptions struct {
+	KeepSize bool //leave the size in the directory entry alone, only reserve clusters; Check reports the extra clusters as a long chain
+	NoZero   bool //keep whatever bytes the reserved clusters already hold instead of zeroing them, ignored in reproducible mode
+}
+
+//reserve clusters for size bytes at path, creating the file if needed, new space reads as zeros
+func (f *fat16) Fallocate(path string, size int64) error {
+	return f.FallocateWithOptions(path, size, FallocateOptions{})
+}
+
+//reserve clusters for size bytes at path, creating the file if needed; a file is never shrunk
+func (f *fat16) FallocateWithOptions(path string, size int64, opts FallocateOptions) error {
+	if size < 0 || size > 0xFFFFFFFF {
+		return errors.New("size " + strconv.FormatInt(size, 10) + " is unsupported by FAT")
+	}
+	clusters := f.clustersFor(size)
+	if f.reproducible {
+		opts.NoZero = false
+	}
+
+	entry, err := f.lookup(path)
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err != nil {
+		//new file
+		offset, chain, err := f.makeChainEntry(path, allocRequest{clusters: clusters})
+		if err != nil {
+			return err
+		}
+		if !opts.NoZero {
+			for _, c := range chain {
+				err := f.clearCluster(c)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if opts.KeepSize {
+			return nil
+		}
+		return f.setEntrySize(offset, size)
+	}
+	if entry.IsDir() {
+		return errors.New(path + " is a directory")
+	}
+
+	chain, err := f.getChain(entry.Start)
+	if err != nil {
+		return err
+	}
+	oldChainBytes := int64(len(chain)) * f.CommonSizes.BytesPerCluster
+	if int64(len(chain)) < clusters {
+		added, err := f.extendChain(chain, clusters-int64(len(chain)))
+		if err != nil {
+			return err
+		}
+		if len(chain) == 0 {
+			err = f.setEntryStart(entry.Offset, added[0])
+			if err != nil {
+				f.freeChain(added)
+				return err
+			}
+		}
+		if !opts.NoZero {
+			for _, c := range added {
+				err := f.clearCluster(c)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		chain = append(chain, added...)
+	}
+
+	if opts.KeepSize || size <= entry.Size {
+		return nil
+	}
+	//bytes past the old end of file that were already allocated
+	if !opts.NoZero && entry.Size < oldChainBytes {
+		end := size
+		if end > oldChainBytes {
+			end = oldChainBytes
+		}
+		err := f.zeroRange(chain, entry.Size, end)
+		if err != nil {
+			return err
+		}
+	}
+	return f.setEntrySize(entry.Offset, size)
+}
+
+//number of clusters holding size bytes, a file always gets at least one
+func (f *fat16) clustersFor(size int64) int64 {
+	clusters := (size + f.CommonSizes.BytesPerCluster - 1) / f.CommonSizes.BytesPerCluster
+	if clusters == 0 {
+		clusters = 1
+	}
+	return clusters
+}
+
+//allocate n more clusters after a chain, preferring the clusters right after its last one
+func (f *fat16) extendChain(chain []int64, n int64) ([]int64, error) {
+	req := allocRequest{clusters: n}
+	if len(chain) > 0 && f.isFree(chain[len(chain)-1]+1) {
+		req.firstCluster = chain[len(chain)-1] + 1
+	}
+	added, err := f.allocChain(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) > 0 {
+		f.setFatEntry(chain[len(chain)-1], added[0])
+	}
+	return added, nil
+}
+
+//zero the bytes from start up to end of the data held by a chain
+func (f *fat16) zeroRange(chain []int64, start int64, end int64) error {
+	bytesPerCluster := f.CommonSizes.BytesPerCluster
+	for start < end {
+		within := start % bytesPerCluster
+		length := bytesPerCluster - within
+		if length > end-start {
+			length = end - start
+		}
+		err := writeBytes(f.dev, make([]byte, length), f.GetClusterOffset(chain[start/bytesPerCluster])+within)
+		if err != nil {
+			return err
+		}
+		start += length
+	}
+	return nil
+}
@@ -2,9 +2,13 @@ package lipid
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const VOLUME_START int64 = 0x0
@@ -40,51 +44,104 @@ type Fat16 struct {
 }
 
 type fat16 struct {
-	File             *os.File
+	File             *os.File //image file, read and write through the volume to keep the caches coherent
 	RegionOffsets    fileSystemOffsetStruct
 	CurrentDirOffset int64
 	CommonSizes      sizesStruct
+	BPB              BootParameterBlock
+
+	dev      io.ReadWriteSeeker //block cache, or File if the cache is disabled
+	fat      []uint16           //cached copy of the FAT
+	fatDirty []bool             //FAT sectors changed since the last Flush
+	alloc    allocator
+
+	reproducible bool      //set by SetReproducible
+	fixedTime    time.Time //time stamped on entries in reproducible mode
 }
 
-//open a fat16 image
+//open a fat16 image without a block cache, so data and directory writes go straight to the image file;
+//FAT changes are kept in memory until Flush, Sync or Close
 func OpenFat16Image(path string) (*Fat16, error) {
+	return OpenFat16ImageWithCache(path, BlockCacheOptions{})
+}
+
+//open a fat16 image with the given block cache settings, see DefaultBlockCacheOptions.
+//With the cache on, data and directory writes also stay in memory until Sync or Close, and reads through File see stale data before that
+func OpenFat16ImageWithCache(path string, cacheOpts BlockCacheOptions) (*Fat16, error) {
 	file, err := os.OpenFile(path, os.O_RDWR, 0755)
 	if err != nil {
 		return &Fat16{nil}, err
 	}
 
+	//refuse images whose geometry would lead to bad reads
+	bpb, err := readBootSector(file)
+	if err != nil {
+		file.Close()
+		return &Fat16{nil}, err
+	}
+
 	commonSizes := sizesStruct{
-		SectorsPerCluster: getValue(file, BootSector.SectorsPerCluster),
-		BytesPerSector:    getValue(file, BootSector.BytesPerSector),
-		SectorsPerFat:     getValue(file, BootSector.SectorsPerFat),
-		BytesPerCluster:   getValue(file, BootSector.BytesPerSector) * getValue(file, BootSector.SectorsPerCluster),
+		SectorsPerCluster: int64(bpb.SectorsPerCluster),
+		BytesPerSector:    int64(bpb.BytesPerSector),
+		SectorsPerFat:     int64(bpb.SectorsPerFat),
+		BytesPerCluster:   bpb.BytesPerCluster(),
 	}
 
-	hexData := getRegionData(file)
+	hexData := getRegionData(bpb)
 	f := &Fat16{&fat16{
 		File:             file,
 		RegionOffsets:    hexData,
 		CurrentDirOffset: hexData.RootDirRegion.Offset,
 		CommonSizes:      commonSizes,
+		BPB:              bpb,
 	}}
 
+	//put the block cache between the volume and the image file
+	f.dev = file
+	if cacheOpts.Blocks > 0 {
+		if cacheOpts.BlockSize == 0 {
+			cacheOpts.BlockSize = commonSizes.BytesPerSector
+		}
+		if cacheOpts.BlockSize%commonSizes.BytesPerSector != 0 {
+			file.Close()
+			return &Fat16{nil}, errors.New("block size " + strconv.FormatInt(cacheOpts.BlockSize, 10) + " is not a multiple of the sector size")
+		}
+		f.dev, err = newBlockCache(file, cacheOpts, f.blockKind)
+		if err != nil {
+			file.Close()
+			return &Fat16{nil}, err
+		}
+	}
+
+	err = f.loadFat()
+	if err != nil {
+		file.Close()
+		return &Fat16{nil}, err
+	}
+
 	return f, nil
 }
-func (f *fat16) Close() { f.File.Close() }
+
+//write every pending change and close the image, the returned error tells whether they made it to the file
+func (f *fat16) Close() error {
+	err := f.Sync()
+	closeErr := f.File.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
 
 //get offset of provided cluster number
 func (f *fat16) GetClusterOffset(clusterN int64) int64 {
-	bytesPerSector := getValue(f.File, BootSector.BytesPerSector)
-	sectorsPerCluster := getValue(f.File, BootSector.SectorsPerCluster)
-
-	firstSector := (f.RegionOffsets.DataRegion.Offset) + ((clusterN - 2) * sectorsPerCluster * bytesPerSector)
+	firstSector := (f.RegionOffsets.DataRegion.Offset) + ((clusterN - 2) * f.CommonSizes.BytesPerCluster)
 
 	return firstSector
 }
 
 //get FAT sector of provided cluster
 func (f *fat16) GetClusterSector(fatSectorN int64) int64 {
-	bytesPerSector := getValue(f.File, BootSector.BytesPerSector)
+	bytesPerSector := f.CommonSizes.BytesPerSector
 	fatNumOffset := f.RegionOffsets.FATRegion.Offset
 	clusterSector := fatNumOffset + (fatSectorN*2)/bytesPerSector
 
@@ -93,40 +150,39 @@ func (f *fat16) GetClusterSector(fatSectorN int64) int64 {
 
 //read a file from a given offset
 func (f *fat16) ReadFile(path string, outPath string) error {
-	fileOffset := f.findOffset(f.CurrentDirOffset, path)
-	if fileOffset == -1 {
+	entry, err := f.lookup(path)
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err != nil || entry.IsDir() {
 		errorMessage := "file " + path + " not found"
 		return errors.New(errorMessage)
 	}
+	return f.readEntry(path, entry, outPath, 0755)
+}
 
-	fileSize := getValue(f.File, offsetObject{directoryEntryOffsets.FileSize.Offset + fileOffset, directoryEntryOffsets.FileSize.Length})
-	clusterSize := getValue(f.File, BootSector.BytesPerSector) * getValue(f.File, BootSector.SectorsPerCluster)
-
-	fileDirEntry := offsetObject{directoryEntryOffsets.StartingCluster.Offset + fileOffset, directoryEntryOffsets.StartingCluster.Length}
-	startCluster := getValue(f.File, fileDirEntry)
-
-	fatNumOffset := (f.RegionOffsets.FATRegion.Offset)
+//write the contents of a file entry to outPath on the host
+func (f *fat16) readEntry(path string, entry dirEntry, outPath string, mode os.FileMode) error {
+	fileSize := entry.Size
+	clusterSize := f.CommonSizes.BytesPerCluster
+	startCluster := entry.Start
 
 	//generate cluster chain
-	fileClusterChain := []int64{startCluster}
-	nextChainLink := startCluster
-	for {
-		//get chain link
-		nextChainLink = getValue(f.File, offsetObject{fatNumOffset + nextChainLink*2, 2})
-		//check for end of chain
-		if nextChainLink == 0xFFFF {
-			break
-		}
-		fileClusterChain = append(fileClusterChain, nextChainLink)
+	fileClusterChain, err := f.getChain(startCluster)
+	if err != nil {
+		return err
+	}
+	if int64(len(fileClusterChain))*clusterSize < fileSize {
+		return fmt.Errorf("%w: %s is %d bytes but its chain holds only %d clusters", ErrCorrupt, path, fileSize, len(fileClusterChain))
 	}
 
 	//name := f.readName(fileOffset)
 
-	err := ioutil.WriteFile(outPath, []byte(""), 0755)
+	err = ioutil.WriteFile(outPath, []byte(""), mode)
 	if err != nil {
 		return err
 	}
-	outFile, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY, 0755)
+	outFile, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
@@ -141,14 +197,21 @@ func (f *fat16) ReadFile(path string, outPath string) error {
 		if numberOfBytes > clusterSize {
 			numberOfBytes = clusterSize
 		}
+		//chain is longer than the file
+		if numberOfBytes <= 0 {
+			break
+		}
 
 		//write cluster to output file
 		clusterOffset := (f.RegionOffsets.DataRegion.Offset) + ((cluster - 2) * clusterSize)
-		byteArray, err := readBytes(f.File, clusterOffset, numberOfBytes, false)
+		byteArray, err := readBytes(f.dev, clusterOffset, numberOfBytes, false)
+		if err != nil {
+			return err
+		}
+		_, err = outFile.Write(byteArray)
 		if err != nil {
 			return err
 		}
-		outFile.Write(byteArray)
 	}
 
 	return nil
@@ -172,224 +235,220 @@ func (f *fat16) ListCurrentDir() ([]string, error) {
 
 //list contents of directory at provided path
 func (f *fat16) ListDir(path string) ([]string, error) {
-
-	returnSlice := make([]string, 0)
-	var dirOffset int64
-	if path == "." {
-		dirOffset = f.CurrentDirOffset
-	} else {
-		var err error
-		dirOffset, err = f.getPathOffset(path)
-		if err != nil {
-			return make([]string, 0), errors.New("could not find " + path)
-		}
-	}
-	if dirOffset == f.RegionOffsets.RootDirRegion.Offset || getValue(f.File, offsetObject{dirOffset + 0x1A, 2}) == 0x00 {
-		i := int64(0x00)
-		//set dirOffset to root offset (if right side of OR is true, this may not have the correct value)
-		dirOffset = f.RegionOffsets.RootDirRegion.Offset
-		for i < f.RegionOffsets.RootDirRegion.Length {
-			off := dirOffset + i
-			lfnOff := int64(1)
-			//check for LFN
-			if getValue(f.File, offsetObject{off + 0xB, 1}) == 0x0F {
-				lfnOff += int64(getValue(f.File, offsetObject{off, 1}) & 0x3F)
-			}
-			name := f.readName(off)
-			if name != "" {
-				returnSlice = append(returnSlice, name)
-			}
-			i += (lfnOff * 32) //one file metadata unit is 32 bytes
-		}
-		return returnSlice, nil
+	entry, err := f.lookup(path)
+	if errors.Is(err, ErrCorrupt) {
+		return make([]string, 0), err
+	}
+	if err != nil {
+		return make([]string, 0), errors.New("could not find " + path)
+	}
+	if !entry.IsDir() {
+		return make([]string, 0), errors.New(path + " is not a directory")
 	}
 
-	//check if "Dir" is actually a directory
-	attributeByte := getValue(f.File, offsetObject{directoryEntryOffsets.AttributeByte.Offset + dirOffset, directoryEntryOffsets.AttributeByte.Length})
-	if (attributeByte & 0x10) == 0x10 {
-		clusterNumberOffset := int64(0x1A + dirOffset)
-		clusterN := getValue(f.File, offsetObject{clusterNumberOffset, 2})
-		sectorsPerCluster := getValue(f.File, BootSector.SectorsPerCluster)
-		bytesPerSector := getValue(f.File, BootSector.BytesPerSector)
-		clusterSize := f.CommonSizes.BytesPerCluster
-
-		clusterOffset := (f.RegionOffsets.DataRegion.Offset) + ((clusterN - 2) * sectorsPerCluster * bytesPerSector)
-
-		i := int64(0x00)
-		for i < clusterSize {
-			off := clusterOffset + i
-			lfnOff := int64(1)
-			//check for LFN
-			if getValue(f.File, offsetObject{off + 0xB, 1}) == 0x0F {
-				lfnOff += int64(getValue(f.File, offsetObject{off, 1}) & 0x3F)
-			}
-			name := f.readName(off)
-			if name != "" {
-				returnSlice = append(returnSlice, name)
-			}
-			i += (lfnOff * 32) //one file metadata unit is 32 bytes
-		}
-		return returnSlice, nil
+	entries, err := f.readDir(entry.Start)
+	if err != nil {
+		return make([]string, 0), err
 	}
-	return make([]string, 0), errors.New(path + " is not a directory")
+	returnSlice := make([]string, 0, len(entries))
+	for _, e := range entries {
+		returnSlice = append(returnSlice, e.Name)
+	}
+	return returnSlice, nil
 }
 
 //make a directory
 func (f *fat16) MakeDir(name string) error {
+	parentCluster, err := f.parentCluster(strings.TrimRight(name, "/"))
+	if err != nil {
+		return err
+	}
 	//make entry
-	entryOff, err := f.makeEntry(name)
+	entryOff, chain, err := f.makeChainEntry(name, allocRequest{clusters: 1})
 	if err != nil {
 		return err
 	}
+	childCluster := chain[0]
 	//set bit 0x10 on attribute byte
-	attrByte := byte(getValue(f.File, offsetObject{entryOff + 0x0B, 1})) | 0x10
-	err = writeBytes(f.File, []byte{attrByte}, entryOff+0x0B)
+	entry, err := readBytes(f.dev, entryOff, 32, false)
+	if err != nil {
+		return err
+	}
+	entry[0x0B] |= 0x10
+	err = f.writeEntryBytes(entry[0x0B:0x0C], entryOff+0x0B)
 	if err != nil {
 		return err
 	}
 
 	//clear out folder cluster
-	childCluster := getValue(f.File, offsetObject{entryOff + 0x1A, 2})
-	f.clearCluster(childCluster)
+	err = f.clearCluster(childCluster)
+	if err != nil {
+		return err
+	}
 
 	//CREATE . AND .. ENTRIES
-	//create '.' entry array
-	temp := f.GetClusterOffset(childCluster)
-
-	childDirByteArray := make([]byte, 0)
-	childDirByteArray = append(childDirByteArray, []byte(".")...)
-	for len(childDirByteArray) < 8 {
-		childDirByteArray = append(childDirByteArray, 0x20)
-	}
-	childDirByteArray = append(childDirByteArray, []byte("")...)
-	for len(childDirByteArray) < 11 {
-		childDirByteArray = append(childDirByteArray, 0x20)
-	}
-	//attribute byte
-	childDirByteArray = append(childDirByteArray, 0x10)
-	//attribute, reserved, and creation
-	for i := 0; i < 4; i++ {
-		childDirByteArray = append(childDirByteArray, 0x00)
-	}
-	//creation date
-	childDirByteArray = append(childDirByteArray, []byte{0x00, 0x21}...)
-	//last access date
-	childDirByteArray = append(childDirByteArray, []byte{0x00, 0x21}...)
-	//reserved, last write time
-	for i := 0; i < 4; i++ {
-		childDirByteArray = append(childDirByteArray, 0x00)
-	}
-	//last write date
-	childDirByteArray = append(childDirByteArray, []byte{0x00, 0x21}...)
-	//starting cluster
-	childDirByteArray = append(childDirByteArray, byte((childCluster)&0x0000FFFF))
-	childDirByteArray = append(childDirByteArray, byte((childCluster)&0xFFFF0000))
-	//file size
-	for i := 0; i < 4; i++ {
-		childDirByteArray = append(childDirByteArray, 0x00)
-	}
-
-	//create '..' entry array
-	parentCluster := f.GetClusterOffset(temp)
-	parentDirByteArray := make([]byte, 0)
-	parentDirByteArray = append(parentDirByteArray, []byte("..")...)
-	for len(parentDirByteArray) < 8 {
-		parentDirByteArray = append(parentDirByteArray, 0x20)
-	}
-	parentDirByteArray = append(parentDirByteArray, []byte("")...)
-	for len(parentDirByteArray) < 11 {
-		parentDirByteArray = append(parentDirByteArray, 0x20)
-	}
-	//attribute byte
-	parentDirByteArray = append(parentDirByteArray, 0x10)
-	//reserved, and creation
-	for i := 0; i < 4; i++ {
-		parentDirByteArray = append(parentDirByteArray, 0x00)
-	}
-	//creation date
-	parentDirByteArray = append(parentDirByteArray, []byte{0x00, 0x21}...)
-	//last access date
-	parentDirByteArray = append(parentDirByteArray, []byte{0x00, 0x21}...)
-	//reserved, last write time
-	for i := 0; i < 4; i++ {
-		parentDirByteArray = append(parentDirByteArray, 0x00)
-	}
-	//last write date
-	parentDirByteArray = append(parentDirByteArray, []byte{0x00, 0x21}...)
-	//starting cluster
-	parentDirByteArray = append(parentDirByteArray, byte((parentCluster)&0x0000FFFF))
-	parentDirByteArray = append(parentDirByteArray, byte((parentCluster)&0xFFFF0000))
-	//file size
-	for i := 0; i < 4; i++ {
-		parentDirByteArray = append(parentDirByteArray, 0x00)
-	}
-
-	err = writeBytes(f.File, childDirByteArray, temp)
+	dots := append(dotEntry(".", entry, childCluster), dotEntry("..", entry, parentCluster)...)
+	return f.writeEntryBytes(dots, f.GetClusterOffset(childCluster))
+}
+
+//make a directory along with any missing parent directories, existing directories are left alone
+func (f *fat16) MkdirAll(path string) error {
+	prefix := ""
+	if strings.HasPrefix(path, "/") {
+		prefix = "/"
+	}
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." {
+			continue
+		}
+		prefix += p
+		entry, err := f.lookup(prefix)
+		if errors.Is(err, ErrCorrupt) {
+			return err
+		}
+		if err != nil {
+			err = f.MakeDir(prefix)
+			if err != nil {
+				return err
+			}
+		} else if !entry.IsDir() {
+			return errors.New(prefix + " is not a directory")
+		}
+		prefix += "/"
+	}
+	return nil
+}
+
+//'.' or '..' entry pointing at cluster, cluster 0 for the root directory; timestamps come from the directory's entry
+func dotEntry(name string, dirEntry []byte, cluster int64) []byte {
+	e := append([]byte(nil), dirEntry...)
+	copy(e[:11], []byte(name+"          ")[:11])
+	e[0x0B] = 0x10
+	e[0x0C] = 0x00
+	e[0x1A] = byte(cluster & 0x00FF)
+	e[0x1B] = byte((cluster & 0xFF00) >> 8)
+	for i := 0x1C; i < 0x20; i++ {
+		e[i] = 0x00
+	}
+	return e
+}
+
+//remove a file or an empty directory
+func (f *fat16) Remove(name string) error {
+	entry, err := f.lookup(name)
 	if err != nil {
 		return err
 	}
-	err = writeBytes(f.File, parentDirByteArray, temp+32)
+	if entry.Offset == -1 || entry.IsDot() {
+		return errors.New("cannot remove " + name)
+	}
+
+	//directories have to be empty
+	if entry.IsDir() {
+		entries, err := f.readDir(entry.Start)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDot() {
+				return errors.New(name + " is not empty")
+			}
+		}
+	}
+
+	//walk the chain before touching anything, so a corrupt chain leaves the entry in place
+	chain, err := f.getChain(entry.Start)
+	if err != nil {
+		return err
+	}
+	err = f.deleteEntrySlots(entry)
 	if err != nil {
 		return err
 	}
+	f.freeChain(chain)
 
 	return nil
 }
 
-//remove an entry
-func (f *fat16) Remove(name string) error {
-	//get offset of entry to remove
-	offset, err := f.getPathOffset(name)
+//remove an entry and everything under it, a path that does not exist is not an error
+func (f *fat16) RemoveAll(name string) error {
+	entry, err := f.lookup(name)
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+	if entry.Offset == -1 {
+		return errors.New("cannot remove the root directory")
+	}
+	if entry.IsDot() {
+		return errors.New("cannot remove " + name)
+	}
+
+	//gather every entry and cluster first, so a corrupt tree is left untouched
+	entries := []dirEntry{entry}
+	clusters := make(map[int64]bool)
+	err = f.collectTree(entry, &entries, clusters, make(map[int64]bool))
 	if err != nil {
 		return err
 	}
 
-	//entry is a directory
-	if (getValue(f.File, offsetObject{offset + 0x0B, 1})&0x10 == 0x10) {
-		//entry is not a special directory, remove files and proceed
-		if (f.readName(offset) != ".") && (f.readName(offset) != "..") {
-			subEntries, _ := f.ListDir(name)
-			for _, s := range subEntries {
-				err := f.Remove((name + "/" + s))
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			//special directory (. or ..), mark entry as removed and return
-			err = writeBytes(f.File, []byte{0xE5}, offset)
-			if err != nil {
-				return err
-			}
-			return nil
+	for _, e := range entries {
+		err := f.deleteEntrySlots(e)
+		if err != nil {
+			return err
 		}
 	}
+	//cross-linked clusters are only freed once
+	for c := range clusters {
+		f.setFatEntry(c, fat16Free)
+	}
+	return nil
+}
 
-	//mark non-lfn entry as removed
-	err = writeBytes(f.File, []byte{0xE5}, offset)
+//add the clusters of an entry, and for a directory every entry under it, dot entries excluded
+func (f *fat16) collectTree(entry dirEntry, entries *[]dirEntry, clusters map[int64]bool, visited map[int64]bool) error {
+	chain, err := f.getChain(entry.Start)
 	if err != nil {
 		return err
 	}
-	//mark lfn entry(s) as removed
-	for i := int64(1); getValue(f.File, offsetObject{(offset - (i * 32) + 0x0B), 1}) == 0x0F && getValue(f.File, offsetObject{(offset - (i * 32)), 1}) != 0xE5; i++ {
-		err = writeBytes(f.File, []byte{0xE5}, offset-(i*32))
+	for _, c := range chain {
+		clusters[c] = true
+	}
+	if !entry.IsDir() {
+		return nil
+	}
+
+	err = checkDirLoop(visited, entry.Start)
+	if err != nil {
+		return err
+	}
+	children, err := f.readDir(entry.Start)
+	if err != nil {
+		return err
+	}
+	for _, e := range children {
+		if e.IsDot() {
+			continue
+		}
+		*entries = append(*entries, e)
+		err := f.collectTree(e, entries, clusters, visited)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	//free FAT data
-	numberOfFats := getValue(f.File, BootSector.FatCopies)
-	for fatNum := 0; fatNum < int(numberOfFats); fatNum++ {
-		fatNumOffset := f.RegionOffsets.FATRegion.Offset + (int64(fatNum) * (f.RegionOffsets.FATRegion.Length / numberOfFats))
-		nextClusterNumber := getValue(f.File, offsetObject{offset + 0x1A, 2})
-		for nextClusterNumber != 0xFFFF {
-			temp := nextClusterNumber
-			nextClusterNumber = getValue(f.File, offsetObject{fatNumOffset + nextClusterNumber*2, 2})
-			writeBytes(f.File, []byte{0x00, 0x00}, fatNumOffset+(2*temp))
+//mark the short entry and LFN entries of an entry as deleted
+func (f *fat16) deleteEntrySlots(entry dirEntry) error {
+	for _, o := range entry.Slots {
+		err := f.writeEntryBytes([]byte{0xE5}, o)
+		if err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
@@ -398,8 +457,21 @@ func (f *fat16) MakeEmptyFile(path string) (int64, error) {
 	return f.makeEntry(path)
 }
 
+//where AddFileWithOptions puts the file's clusters
+type AddFileOptions struct {
+	Contiguous   bool  //fail unless the file fits in one run of free clusters
+	FirstCluster int64 //cluster the file has to start at, 0 to let the allocator choose
+	MakeParents  bool  //create missing parent directories instead of failing
+	Replace      bool  //overwrite an existing file instead of failing, keeping its creation time and attributes
+}
+
 //add a file to the FAT image
 func (f *fat16) AddFile(inFilePath string, imgPath string) error {
+	return f.AddFileWithOptions(inFilePath, imgPath, AddFileOptions{})
+}
+
+//add a file to the FAT image, placing its clusters as opts asks
+func (f *fat16) AddFileWithOptions(inFilePath string, imgPath string, opts AddFileOptions) error {
 	//open file to add to FAT image
 	inFile, err := os.Open(inFilePath)
 	if err != nil {
@@ -419,78 +491,108 @@ func (f *fat16) AddFile(inFilePath string, imgPath string) error {
 		return errors.New(inFilePath + " is larger than 4GB, which is unsupported by FAT")
 	}
 
+	if opts.MakeParents {
+		if i := strings.LastIndex(imgPath, "/"); i > 0 {
+			err := f.MkdirAll(imgPath[:i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	numberOfClusters := fileSize / f.CommonSizes.BytesPerCluster
 	if fileSize%f.CommonSizes.BytesPerCluster != 0 || numberOfClusters == 0 {
 		numberOfClusters++
 	}
 
-	//calculate FAT chain
-	fatChain := make([]int16, 0)
-	fatOffset := f.RegionOffsets.FATRegion.Offset
-	latestFatOffset := int64(4)
-	for i := int64(0); i < numberOfClusters; i++ {
-		for latestFatOffset += 2; getValue(f.File, offsetObject{fatOffset + latestFatOffset, 2}) != 0; latestFatOffset += 2 {
-			if latestFatOffset > f.RegionOffsets.FATRegion.Length {
-				return errors.New("not enough free space to add file " + inFilePath)
-			}
+	req := allocRequest{clusters: numberOfClusters, contiguous: opts.Contiguous, firstCluster: opts.FirstCluster}
+
+	//swap the contents of an existing file
+	if opts.Replace {
+		entry, err := f.lookup(imgPath)
+		if errors.Is(err, ErrCorrupt) {
+			return err
+		}
+		if err == nil {
+			return f.replaceFile(inFile, fileSize, entry, req)
 		}
-		fatChain = append(fatChain, int16(latestFatOffset/2))
 	}
 
-	//add entry
-	entryOffset, err := f.makeEntry(imgPath)
+	//add entry and allocate its chain
+	entryOffset, fatChain, err := f.makeChainEntry(imgPath, req)
 	if err != nil {
 		return err
 	}
 
 	//update file size in entry
-	sizeBytes := []byte{byte(fileSize & 0x000000FF), byte((fileSize & 0x0000FF00) >> 8), byte((fileSize & 0x00FF0000) >> 16), byte((fileSize & 0xFF000000) >> 24)}
-	err = writeBytes(f.File, sizeBytes, entryOffset+0x1C)
+	err = f.setEntrySize(entryOffset, fileSize)
 	if err != nil {
 		return err
 	}
 
-	for s, i := range fatChain {
-		seekPos := int64(s) * f.CommonSizes.BytesPerCluster
-		clusterOffset := f.GetClusterOffset(int64(i))
-		err := f.clearCluster(int64(i))
+	return f.writeChainData(inFile, fileSize, fatChain)
+}
+
+//copy size bytes read in order from in to the clusters of chain, the rest of the last cluster is zeroed
+func (f *fat16) writeChainData(in io.Reader, size int64, chain []int64) error {
+	buffer := make([]byte, f.CommonSizes.BytesPerCluster)
+	for s, i := range chain {
+		err := f.clearCluster(i)
 		if err != nil {
 			return err
 		}
 
-		//create byte slice to fill one sector, repeat until cluster is filled
-		for j := int64(0); j < f.CommonSizes.SectorsPerCluster && (seekPos+(j*f.CommonSizes.BytesPerSector)) < inFileStats.Size(); j++ {
-			//read bytes from inFile
-			sectorBytes, err := readBytes(inFile, seekPos+(j*f.CommonSizes.BytesPerSector), f.CommonSizes.BytesPerSector, false)
-			if err != nil {
-				return err
-			}
+		//fill the cluster with the next part of the file
+		length := size - int64(s)*f.CommonSizes.BytesPerCluster
+		if length <= 0 {
+			continue
+		}
+		if length > f.CommonSizes.BytesPerCluster {
+			length = f.CommonSizes.BytesPerCluster
+		}
+		_, err = io.ReadFull(in, buffer[:length])
+		if err != nil {
+			return err
+		}
 
-			//write bytes to fat image
-			writeBytes(f.File, sectorBytes, clusterOffset+(j*f.CommonSizes.BytesPerSector))
+		//write bytes to fat image
+		err = writeBytes(f.dev, buffer[:length], f.GetClusterOffset(i))
+		if err != nil {
+			return err
 		}
 	}
 
-	//write FAT chain
-	numFats := getValue(f.File, offsetObject{BootSector.FatCopies.Offset, BootSector.FatCopies.Length})
-	for i := 0; i < int(numFats); i++ {
-		fatOffset = f.RegionOffsets.FATRegion.Offset + int64(i)*f.RegionOffsets.FATRegion.Length
+	return nil
+}
 
-		//update FAT
-		for j := 1; j < len(fatChain); j++ {
-			currentClusterNumber := fatChain[j-1]
-			nextClusterNumber := fatChain[j]
-			clusterFatOffset := fatOffset + (int64(currentClusterNumber) * 2)
+//write a file into a new chain, then point its entry at it in a single write and free the old chain
+func (f *fat16) replaceFile(in io.Reader, size int64, entry dirEntry, req allocRequest) error {
+	if entry.IsDir() {
+		return errors.New(entry.Name + " is a directory")
+	}
+	//walk the old chain first, so a corrupt chain leaves the file untouched
+	oldChain, err := f.getChain(entry.Start)
+	if err != nil {
+		return err
+	}
 
-			clusterBytes := []byte{byte((nextClusterNumber) & 0x00FF), byte((int(nextClusterNumber) & 0xFF00) >> 8)}
-			writeBytes(f.File, clusterBytes, clusterFatOffset)
-		}
-		//set last entry in fatChain to have 0xFFFF
-		clusterBytes := []byte{0xFF, 0xFF}
-		clusterFatOffset := fatOffset + (int64(fatChain[len(fatChain)-1]) * 2)
-		writeBytes(f.File, clusterBytes, clusterFatOffset)
+	chain, err := f.allocChain(req)
+	if err != nil {
+		return err
+	}
+	err = f.writeChainData(in, size, chain)
+	if err != nil {
+		f.freeChain(chain)
+		return err
+	}
+
+	err = f.updateEntry(entry, chain[0], size)
+	if err != nil {
+		f.freeChain(chain)
+		return err
 	}
 
+	f.freeChain(oldChain)
 	return nil
 }
 
@@ -500,7 +602,7 @@ func (f *fat16) Move(inPath string, outPath string) error {
 	if err != nil {
 		return err
 	}
-	inEntryIsDir := (getValue(f.File, offsetObject{inOffset + 0x0B, 1}) & 0x10) == 0x10
+	inEntryIsDir := (getValue(f.dev, offsetObject{inOffset + 0x0B, 1}) & 0x10) == 0x10
 
 	//create partial outpath (used if for a rename)
 	outSplit := strings.Split(outPath, "/")
@@ -541,23 +643,23 @@ func (f *fat16) Move(inPath string, outPath string) error {
 	if !renameMode {
 		var entries = int64(0)
 		//count lfn entries (if present)
-		if getValue(f.File, offsetObject{inOffset - 32 + 0x0B, 1}) == 0x0F {
+		if getValue(f.dev, offsetObject{inOffset - 32 + 0x0B, 1}) == 0x0F {
 			//count number of lfn entries
-			for entries = 1; (getValue(f.File, offsetObject{inOffset - (32 * entries), 1}) & 0x40) != 0x40; entries++ {
+			for entries = 1; (getValue(f.dev, offsetObject{inOffset - (32 * entries), 1}) & 0x40) != 0x40; entries++ {
 			}
 		}
 		//add an entry for non-lfn name
 		entries++
 
 		//read entry bytes
-		bytesToWrite, err := readBytes(f.File, inOffset-(32*(entries-1)), (entries * 32), false)
+		bytesToWrite, err := readBytes(f.dev, inOffset-(32*(entries-1)), (entries * 32), false)
 		if err != nil {
 			return err
 		}
 
 		//locate region to write entry to
 		//get offset of directory cluster
-		outClusterOffset := getValue(f.File, offsetObject{outOffset + 0x1A, 2})
+		outClusterOffset := getValue(f.dev, offsetObject{outOffset + 0x1A, 2})
 		if outClusterOffset == -1 {
 			return errors.New("an unexpected error has occurred")
 		}
@@ -583,7 +685,7 @@ func (f *fat16) Move(inPath string, outPath string) error {
 			//look for section with appropriate number of adjacent entries
 			for j := int64(0); j < entries; j++ {
 				//check if entry value is free
-				val := getValue(f.File, offsetObject{off + int64(j*32), 1})
+				val := getValue(f.dev, offsetObject{off + int64(j*32), 1})
 				if !(val == 0x00 || val == 0xE5) {
 					found = false
 					break
@@ -602,54 +704,24 @@ func (f *fat16) Move(inPath string, outPath string) error {
 
 		//adjust non-lfn entry as needed
 		bytesToWriteLength := len(bytesToWrite)
-		regularName := ""
-		regularExt := ""
-		for i := 0; i < 8; i++ {
-			regularName += string(bytesToWrite[bytesToWriteLength-32+i])
-		}
-		for i := 0; i < 3; i++ {
-			regularExt += string(bytesToWrite[bytesToWriteLength-24+i])
-		}
-
-		temp := []byte(regularName)
-		tempExt := ""
-		if regularExt != "" {
-			tempExt = "." + regularExt
-		}
-		for f.findOffset(outDirOffset, (string(temp)+tempExt)) != -1 {
-			//increase last character
-			temp[7] += 1
-			//check for rollover
-			if temp[7] == 0x3A {
-				temp[7] = '0'
-				temp[5] += 1
-			}
-			//check for rollover in all other characters
-			for i := 5; i > 0; i-- {
-				if temp[i] == 0x5B {
-					temp[i] = 'A'
-					temp[i-1] += 1
-				}
-			}
-			//check final character for rollover (entry cannot be created)
-			if temp[0] == 0x5B {
-				return errors.New("could not create entry with this name")
-			}
+		siblings, err := f.readDir(outClusterOffset)
+		if err != nil {
+			return err
 		}
-		//write adjusted name back to bytesToWrite
-		for i, c := range temp {
-			bytesToWrite[bytesToWriteLength-32+i] = c
+		err = setFreeAlias(bytesToWrite, func(alias string) bool { return nameTaken(siblings, alias) })
+		if err != nil {
+			return err
 		}
 
 		//write entry to new location
-		err = writeBytes(f.File, bytesToWrite, entryOffset)
+		err = f.writeEntryBytes(bytesToWrite, entryOffset)
 		if err != nil {
 			return err
 		}
 
 		//mark original entry as removed
 		for i := int64(0); i < entries; i++ {
-			writeBytes(f.File, []byte{0xE5}, inOffset-(32*i))
+			f.writeEntryBytes([]byte{0xE5}, inOffset-(32*i))
 		}
 
 		//if entry moved was a directory, update .. subentry
@@ -663,7 +735,7 @@ func (f *fat16) Move(inPath string, outPath string) error {
 			bytesToWrite := []byte{byte(outClusterOffset & 0x00FF), byte((outClusterOffset & 0xFF00) >> 8)}
 
 			//write new offset to entry
-			writeBytes(f.File, bytesToWrite, entryOffset)
+			f.writeEntryBytes(bytesToWrite, entryOffset)
 		}
 
 	} else {
@@ -672,66 +744,3 @@ func (f *fat16) Move(inPath string, outPath string) error {
 
 	return nil
 }
-
-/*
-//create a fat16 image
-func MakeFat16(imgPath string, imgSizeBytes int64, args fatArgs) (*fat16, error) {
-	//open file
-	file, err := os.Create(imgPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	//adjust file size
-	err = file.Truncate(imgSizeBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	//create FAT header
-	jumpBytes := []byte{0xEB, 0x3C, 0x90}
-	oemBytes := []byte(OEM_ID)
-
-	//convert args to byte array
-	if !(args.BytesPerSector == 512 || args.BytesPerSector == 1024 || args.BytesPerSector == 2048 || args.BytesPerSector == 4096) {
-		return nil, errors.New(strconv.FormatInt(int64(args.BytesPerSector), 10) + " is not a valid value for BytesPerSector! (512, 1024, 2048, or 4096)")
-	}
-	bytesPerSector := []byte{byte(args.BytesPerSector & 0x00FF), byte((int(args.BytesPerSector) & 0xFF00) >> 8)}
-
-	if !(args.SectorsPerCluster == 1 || args.SectorsPerCluster == 2 || args.SectorsPerCluster == 4 || args.SectorsPerCluster == 8 || args.SectorsPerCluster == 16 || args.SectorsPerCluster == 32 || args.SectorsPerCluster == 64 || args.SectorsPerCluster == 128) && args.SectorsPerCluster != 255 {
-		return nil, errors.New(strconv.FormatInt(int64(args.SectorsPerCluster), 10) + " is not a valid value for SectorsPerCluster! (1, 2, 4, 8, 16, 32, 64, or 128, or 255 to calcuate optimal value)")
-	}
-	var sectorsPerCluster []byte
-	if args.SectorsPerCluster == 255 {
-		//calculate ideal value
-		//CURRENTLY HARDCODED
-		sectorsPerCluster = []byte{byte(0x04)}
-
-	} else {
-		sectorsPerCluster = []byte{byte(args.SectorsPerCluster)}
-	}
-
-	reservedSectors := []byte{byte(args.ReservedSectors & 0x00FF), byte((uint(args.ReservedSectors) & 0xFF00) >> 8)}
-	numberOfFats := []byte{byte(args.NumberOfFats & 0x00FF), byte((uint(args.NumberOfFats) & 0xFF00) >> 8)}
-	rootEntries := []byte{byte(args.NumberOfRootEntries & 0x00FF), byte((uint(args.NumberOfRootEntries) & 0xFF00) >> 8)}
-
-	mediaDescriptor := []byte{byte(args.MediaDescriptor)}
-	sectorsPerFat := []byte{byte(args.SectorsPerFat & 0x00FF), byte((uint(args.SectorsPerFat) & 0xFF00) >> 8)}
-	sectorsPerTrack := []byte{byte(args.SectorsPerTrack & 0x00FF), byte((uint(args.SectorsPerTrack) & 0xFF00) >> 8)}
-	numberOfHeads := []byte{byte(args.NumberOfHeads & 0x00FF), byte((uint(args.NumberOfHeads) & 0xFF00) >> 8)}
-
-	hiddenSectors := []byte{byte(args.HiddenSectors & 0x000000FF), byte((args.HiddenSectors & 0x0000FF00) >> 8), byte((args.HiddenSectors & 0x00FF0000) >> 16), byte((args.HiddenSectors & 0xFF000000) >> 24)}
-
-	//small/large number of sectors
-	var numberOfSmallSectors []byte
-	var numberOfLargeSectors []byte
-	if imgSizeBytes < 33554432 {
-		numberOfLargeSectors = []byte{0x00, 0x00, 0x00, 0x00}
-	} else {
-		numberOfSmallSectors = []byte{0x00, 0x00}
-	}
-
-	return nil, nil
-}
-*/
@@ -0,0 +1,84 @@
+package lipid
+
+//load the first FAT into memory, every FAT lookup and change goes through this copy
+func (f *fat16) loadFat() error {
+	fatLength := f.CommonSizes.SectorsPerFat * f.CommonSizes.BytesPerSector
+	raw, err := readBytes(f.dev, f.RegionOffsets.FATRegion.Offset, fatLength, false)
+	if err != nil {
+		return err
+	}
+	f.fat = make([]uint16, len(raw)/2)
+	for i := range f.fat {
+		f.fat[i] = uint16(raw[i*2]) | uint16(raw[i*2+1])<<8
+	}
+	f.fatDirty = make([]bool, f.CommonSizes.SectorsPerFat)
+	f.buildFreeMap()
+	return nil
+}
+
+//get the FAT value of a cluster
+func (f *fat16) getFatEntry(cluster int64) int64 {
+	if cluster < 0 || cluster >= int64(len(f.fat)) {
+		return fat16Bad
+	}
+	return int64(f.fat[cluster])
+}
+
+//set the FAT value of a cluster, written to every FAT copy on the next Flush
+func (f *fat16) setFatEntry(cluster int64, value int64) {
+	if cluster < 0 || cluster >= int64(len(f.fat)) {
+		return
+	}
+	f.fat[cluster] = uint16(value)
+	f.markFree(cluster, value == fat16Free)
+	f.fatDirty[cluster*2/f.CommonSizes.BytesPerSector] = true
+}
+
+//write every changed FAT sector to every FAT copy, Sync makes the change durable
+func (f *fat16) Flush() error {
+	bytesPerSector := f.CommonSizes.BytesPerSector
+	fatLength := f.CommonSizes.SectorsPerFat * bytesPerSector
+	numberOfFats := int64(f.BPB.FatCopies)
+	entriesPerSector := bytesPerSector / 2
+
+	for sector, dirty := range f.fatDirty {
+		if !dirty {
+			continue
+		}
+		raw := make([]byte, bytesPerSector)
+		first := int64(sector) * entriesPerSector
+		for i := int64(0); i < entriesPerSector && first+i < int64(len(f.fat)); i++ {
+			raw[i*2] = byte(f.fat[first+i] & 0x00FF)
+			raw[i*2+1] = byte((f.fat[first+i] & 0xFF00) >> 8)
+		}
+		for n := int64(0); n < numberOfFats; n++ {
+			err := writeBytes(f.dev, raw, f.RegionOffsets.FATRegion.Offset+n*fatLength+int64(sector)*bytesPerSector)
+			if err != nil {
+				return err
+			}
+		}
+		f.fatDirty[sector] = false
+	}
+	return nil
+}
+
+//contents of FAT copy n as they will be after the next Flush
+func (f *fat16) readFatCopy(n int64) ([]uint16, error) {
+	fatLength := f.CommonSizes.SectorsPerFat * f.CommonSizes.BytesPerSector
+	raw, err := readBytes(f.dev, f.RegionOffsets.FATRegion.Offset+n*fatLength, fatLength, false)
+	if err != nil {
+		return nil, err
+	}
+	table := make([]uint16, len(raw)/2)
+	for i := range table {
+		table[i] = uint16(raw[i*2]) | uint16(raw[i*2+1])<<8
+	}
+	//unflushed changes go to every copy
+	entriesPerSector := int(f.CommonSizes.BytesPerSector / 2)
+	for sector, dirty := range f.fatDirty {
+		if dirty {
+			copy(table[sector*entriesPerSector:], f.fat[sector*entriesPerSector:(sector+1)*entriesPerSector])
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,253 @@
+package lipid
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cluster counts a FAT16 volume can have, fewer is FAT12 and more is FAT32
+const (
+	fat16MinClusters int64 = 4085
+	fat16MaxClusters int64 = 65524
+)
+
+//create a fat16 image of imgSizeBytes and open it
+func MakeFat16(imgPath string, imgSizeBytes int64, args fatArgs) (*Fat16, error) {
+	if !(args.BytesPerSector == 512 || args.BytesPerSector == 1024 || args.BytesPerSector == 2048 || args.BytesPerSector == 4096) {
+		return nil, errors.New(strconv.FormatInt(int64(args.BytesPerSector), 10) + " is not a valid value for BytesPerSector! (512, 1024, 2048, or 4096)")
+	}
+	totalSectors := imgSizeBytes / int64(args.BytesPerSector)
+	args, err := completeFat16Args(totalSectors, args)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if args.Reproducible {
+		now, err = ReproducibleTime()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if args.VolumeSerial == 0 {
+		args.VolumeSerial = volumeSerial(totalSectors, args, now)
+	}
+
+	//open file
+	file, err := os.Create(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	//adjust file size, the regions after the boot sector start out zeroed
+	err = file.Truncate(imgSizeBytes)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	err = writeBytes(file, bootSectorBytes(totalSectors, args), 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	//the first two FAT entries hold the media descriptor and an end of chain marker
+	bytesPerSector := int64(args.BytesPerSector)
+	fatStart := []byte{args.MediaDescriptor, 0xFF, 0xFF, 0xFF}
+	for i := int64(0); i < int64(args.NumberOfFats); i++ {
+		err := writeBytes(file, fatStart, (int64(args.ReservedSectors)+i*int64(args.SectorsPerFat))*bytesPerSector)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	//volume label entry as the first root directory entry
+	if args.VolumeLabel != "" && args.VolumeLabel != "NO NAME" {
+		label := make([]byte, 32)
+		copy(label, paddedLabel(args.VolumeLabel))
+		label[0x0B] = AttrVolumeLabel
+		stampEntry(label, now)
+		rootOffset := (int64(args.ReservedSectors) + int64(args.NumberOfFats)*int64(args.SectorsPerFat)) * bytesPerSector
+		err := writeBytes(file, label, rootOffset)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	f, err := OpenFat16Image(imgPath)
+	if err != nil || !args.Reproducible {
+		return f, err
+	}
+	err = f.SetReproducible(true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+//fill in the values of args left to be calculated for a volume of totalSectors
+func completeFat16Args(totalSectors int64, args fatArgs) (fatArgs, error) {
+	bytesPerSector := int64(args.BytesPerSector)
+	if args.ReservedSectors == 0 {
+		args.ReservedSectors = 1
+	}
+	if args.NumberOfFats == 0 {
+		args.NumberOfFats = 2
+	}
+	if args.NumberOfRootEntries == 0 {
+		args.NumberOfRootEntries = 512
+	}
+	//the root directory fills whole sectors
+	entriesPerSector := bytesPerSector / 32
+	rootEntries := (int64(args.NumberOfRootEntries) + entriesPerSector - 1) / entriesPerSector * entriesPerSector
+	if rootEntries > 0xFFFF-entriesPerSector+1 {
+		return args, errors.New(strconv.Itoa(int(args.NumberOfRootEntries)) + " root entries do not fit in whole sectors")
+	}
+	args.NumberOfRootEntries = uint16(rootEntries)
+
+	autoCluster := args.SectorsPerCluster == 255
+	if autoCluster {
+		args.SectorsPerCluster = defaultSectorsPerCluster(totalSectors*bytesPerSector, bytesPerSector)
+	} else if args.SectorsPerCluster == 0 || args.SectorsPerCluster&(args.SectorsPerCluster-1) != 0 || args.SectorsPerCluster > 128 {
+		return args, errors.New(strconv.FormatInt(int64(args.SectorsPerCluster), 10) + " is not a valid value for SectorsPerCluster! (1, 2, 4, 8, 16, 32, 64, or 128, or 255 to calcuate optimal value)")
+	}
+
+	calculateFat := args.SectorsPerFat == 0
+	for {
+		if calculateFat {
+			sectorsPerFat, err := fat16SectorsPerFat(totalSectors, args)
+			if err != nil {
+				return args, err
+			}
+			args.SectorsPerFat = sectorsPerFat
+		}
+		clusters := fat16DataSectors(totalSectors, args) / int64(args.SectorsPerCluster)
+		//smaller clusters for volumes that would otherwise be FAT12
+		if clusters < fat16MinClusters && autoCluster && args.SectorsPerCluster > 1 {
+			args.SectorsPerCluster /= 2
+			continue
+		}
+		if clusters < fat16MinClusters || clusters > fat16MaxClusters {
+			return args, errors.New(strconv.FormatInt(totalSectors*bytesPerSector, 10) + " bytes with " + strconv.Itoa(int(args.SectorsPerCluster)) + " sectors per cluster gives " + strconv.FormatInt(clusters, 10) + " clusters, FAT16 needs " + strconv.FormatInt(fat16MinClusters, 10) + " to " + strconv.FormatInt(fat16MaxClusters, 10))
+		}
+		if int64(args.SectorsPerFat)*bytesPerSector < (clusters+2)*2 {
+			return args, errors.New(strconv.Itoa(int(args.SectorsPerFat)) + " sectors per FAT cannot hold " + strconv.FormatInt(clusters, 10) + " clusters")
+		}
+		return args, nil
+	}
+}
+
+//sectors left for the data region
+func fat16DataSectors(totalSectors int64, args fatArgs) int64 {
+	rootSectors := int64(args.NumberOfRootEntries) * 32 / int64(args.BytesPerSector)
+	return totalSectors - int64(args.ReservedSectors) - int64(args.NumberOfFats)*int64(args.SectorsPerFat) - rootSectors
+}
+
+//smallest FAT holding an entry for every cluster left over once the FATs are in place
+func fat16SectorsPerFat(totalSectors int64, args fatArgs) (uint16, error) {
+	bytesPerSector := int64(args.BytesPerSector)
+	sectorsPerFat := int64(1)
+	for {
+		args.SectorsPerFat = uint16(sectorsPerFat)
+		clusters := fat16DataSectors(totalSectors, args) / int64(args.SectorsPerCluster)
+		if clusters < 0 {
+			return 0, errors.New(strconv.FormatInt(totalSectors, 10) + " sectors are too few for a FAT16 volume")
+		}
+		needed := ((clusters+2)*2 + bytesPerSector - 1) / bytesPerSector
+		if needed <= sectorsPerFat {
+			//jumping ahead can overshoot, a smaller FAT leaves more clusters but may still hold them all
+			for sectorsPerFat > 1 {
+				args.SectorsPerFat = uint16(sectorsPerFat - 1)
+				clusters := fat16DataSectors(totalSectors, args) / int64(args.SectorsPerCluster)
+				if ((clusters+2)*2+bytesPerSector-1)/bytesPerSector > sectorsPerFat-1 {
+					break
+				}
+				sectorsPerFat--
+			}
+			return uint16(sectorsPerFat), nil
+		}
+		if needed > 0xFFFF {
+			return 0, errors.New(strconv.FormatInt(totalSectors, 10) + " sectors are too many for a FAT16 volume")
+		}
+		sectorsPerFat = needed
+	}
+}
+
+//cluster size commonly used for a FAT16 volume of the given size
+func defaultSectorsPerCluster(volumeBytes int64, bytesPerSector int64) uint8 {
+	clusterBytes := int64(32768)
+	for _, limit := range []struct{ volume, cluster int64 }{
+		{16 << 20, 1024},
+		{128 << 20, 2048},
+		{256 << 20, 4096},
+		{512 << 20, 8192},
+		{1 << 30, 16384},
+	} {
+		if volumeBytes <= limit.volume {
+			clusterBytes = limit.cluster
+			break
+		}
+	}
+	if clusterBytes < bytesPerSector {
+		return 1
+	}
+	return uint8(clusterBytes / bytesPerSector)
+}
+
+//boot sector of a FAT16 volume
+func bootSectorBytes(totalSectors int64, args fatArgs) []byte {
+	b := make([]byte, args.BytesPerSector)
+	put := func(o offsetObject, value int64) {
+		for i := int64(0); i < o.Length; i++ {
+			b[o.Offset+i] = byte(value >> (8 * uint(i)))
+		}
+	}
+
+	copy(b, []byte{0xEB, 0x3C, 0x90})
+	copy(b[BootSector.OSName.Offset:], []byte(OEM_ID))
+	put(BootSector.BytesPerSector, int64(args.BytesPerSector))
+	put(BootSector.SectorsPerCluster, int64(args.SectorsPerCluster))
+	put(BootSector.ReservedSectors, int64(args.ReservedSectors))
+	put(BootSector.FatCopies, int64(args.NumberOfFats))
+	put(BootSector.RootEntries, int64(args.NumberOfRootEntries))
+	//small/large number of sectors
+	if totalSectors < 0x10000 {
+		put(BootSector.SmallSectors, totalSectors)
+	} else {
+		put(BootSector.LargeSectors, totalSectors)
+	}
+	put(BootSector.MediaDescriptor, int64(args.MediaDescriptor))
+	put(BootSector.SectorsPerFat, int64(args.SectorsPerFat))
+	put(BootSector.SectorsPerTrack, int64(args.SectorsPerTrack))
+	put(BootSector.NumberOfHeads, int64(args.NumberOfHeads))
+	put(BootSector.HiddenSectors, int64(args.HiddenSectors))
+	put(BootSector.DriveNumber, int64(args.DriveNumber))
+	put(BootSector.ExtBootSig, 0x29)
+	put(BootSector.VolumeSerialNum, int64(args.VolumeSerial))
+	label := args.VolumeLabel
+	if label == "" {
+		label = "NO NAME"
+	}
+	copy(b[BootSector.VolumeLabel.Offset:], paddedLabel(label))
+	copy(b[BootSector.FileSystemType.Offset:], []byte("FAT16   "))
+	put(BootSector.BootSectorSig, 0xAA55)
+	return b
+}
+
+//volume label as the 11 upper case characters stored on disk
+func paddedLabel(label string) []byte {
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	return []byte(label + strings.Repeat(" ", 11-len(label)))
+}
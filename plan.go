@@ -0,0 +1,253 @@
+package lipid
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//FAT variant, named by the width of a FAT entry
+type FatType int
+
+const (
+	FAT12 FatType = 12
+	FAT16 FatType = 16
+	FAT32 FatType = 32
+)
+
+func (t FatType) String() string {
+	switch t {
+	case FAT12, FAT16, FAT32:
+		return "FAT" + strconv.Itoa(int(t))
+	}
+	return "unknown FAT type " + strconv.Itoa(int(t))
+}
+
+//cluster counts each FAT type can have
+func (t FatType) clusterRange() (int64, int64) {
+	switch t {
+	case FAT12:
+		return 1, 4084
+	case FAT16:
+		return fat16MinClusters, fat16MaxClusters
+	}
+	return 65525, 0x0FFFFFF5
+}
+
+//bytes of FAT needed for clusters data clusters plus the two reserved entries
+func (t FatType) fatBytes(clusters int64) int64 {
+	switch t {
+	case FAT12:
+		return ((clusters+2)*3 + 1) / 2
+	case FAT16:
+		return (clusters + 2) * 2
+	}
+	return (clusters + 2) * 4
+}
+
+//a file or directory to plan for, only the name and size matter
+type PlanEntry struct {
+	Path string //slash separated path, parent directories not listed are added
+	Dir  bool
+	Size int64 //ignored for directories
+}
+
+//which layouts PlanLayout considers and how much room it leaves
+type PlanOptions struct {
+	Types          []FatType //FAT types to consider, all three if empty
+	BytesPerSector uint16    //512 if 0
+	RootEntries    uint16    //least root directory entries for FAT12 and FAT16, just enough if 0
+	Label          bool      //room for a volume label entry in the root directory
+	SlackPercent   int64     //free space to leave, as a percentage of the space the content takes
+	SlackBytes     int64     //free space to leave on top of SlackPercent
+}
+
+//a planned volume
+type Layout struct {
+	Type            FatType
+	Args            fatArgs //arguments for MakeFat16, only filled in for FAT16 layouts and zero for FAT12 and FAT32
+	TotalSectors    int64
+	BytesPerSector  int64
+	BytesPerCluster int64
+	SectorsPerFat   int64
+	RootEntries     int64 //0 for FAT32, where the root directory is a cluster chain
+	Clusters        int64 //data clusters on the volume
+	UsedClusters    int64 //clusters the content takes, directories included
+	FreeClusters    int64
+	FreeBytes       int64
+}
+
+//size in bytes of the planned volume
+func (l Layout) Bytes() int64 {
+	return l.TotalSectors * l.BytesPerSector
+}
+
+//smallest layout holding entries, trying every cluster size up to 32KB for each FAT type;
+//files take at least one cluster each, and directories take the clusters their '.', '..', long name and short entries fill
+func PlanLayout(entries []PlanEntry, opts PlanOptions) (Layout, error) {
+	if opts.BytesPerSector == 0 {
+		opts.BytesPerSector = 512
+	}
+	if !(opts.BytesPerSector == 512 || opts.BytesPerSector == 1024 || opts.BytesPerSector == 2048 || opts.BytesPerSector == 4096) {
+		return Layout{}, errors.New(strconv.Itoa(int(opts.BytesPerSector)) + " is not a valid value for BytesPerSector! (512, 1024, 2048, or 4096)")
+	}
+	if opts.SlackPercent < 0 || opts.SlackBytes < 0 {
+		return Layout{}, errors.New("slack cannot be negative")
+	}
+	types := opts.Types
+	if len(types) == 0 {
+		types = []FatType{FAT12, FAT16, FAT32}
+	}
+
+	//files by size and directories by the entry slots they hold, the root directory is keyed "."
+	files := make([]int64, 0, len(entries))
+	slots := map[string]int64{".": 0}
+	isDir := make(map[string]bool)
+	var add func(p string, dir bool, size int64) error
+	add = func(p string, dir bool, size int64) error {
+		if p == "." {
+			return nil
+		}
+		if wasDir, ok := isDir[p]; ok {
+			if wasDir != dir {
+				return errors.New(p + " is both a file and a directory")
+			}
+			return nil
+		}
+		isDir[p] = dir
+		err := add(path.Dir(p), true, 0)
+		if err != nil {
+			return err
+		}
+		slots[path.Dir(p)] += int64(len(generateNameEntry(path.Base(p))) / 32)
+		if dir {
+			slots[p] += 2 //'.' and '..'
+			return nil
+		}
+		if size < 0 || size > 0xFFFFFFFF {
+			return errors.New(p + " has a size of " + strconv.FormatInt(size, 10) + ", which is unsupported by FAT")
+		}
+		files = append(files, size)
+		return nil
+	}
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		p := path.Clean(strings.Trim(e.Path, "/"))
+		if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return Layout{}, errors.New(e.Path + " is not a path inside the volume")
+		}
+		if listed[p] {
+			return Layout{}, errors.New(e.Path + " is listed twice")
+		}
+		listed[p] = true
+		err := add(p, e.Dir, e.Size)
+		if err != nil {
+			return Layout{}, err
+		}
+	}
+	if opts.Label {
+		slots["."]++
+	}
+
+	best := Layout{}
+	for _, t := range types {
+		if t != FAT12 && t != FAT16 && t != FAT32 {
+			return Layout{}, errors.New(t.String())
+		}
+		for sectorsPerCluster := int64(1); sectorsPerCluster*int64(opts.BytesPerSector) <= 32768; sectorsPerCluster *= 2 {
+			l, ok := planType(t, sectorsPerCluster, files, slots, opts)
+			if ok && (best.TotalSectors == 0 || l.TotalSectors < best.TotalSectors) {
+				best = l
+			}
+		}
+	}
+	if best.TotalSectors == 0 {
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = t.String()
+		}
+		return Layout{}, errors.New("content does not fit in " + strings.Join(names, ", ") + " with clusters of up to 32KB")
+	}
+	return best, nil
+}
+
+//layout of type t with the given cluster size, false if the content does not fit
+func planType(t FatType, sectorsPerCluster int64, files []int64, slots map[string]int64, opts PlanOptions) (Layout, bool) {
+	bytesPerSector := int64(opts.BytesPerSector)
+	bytesPerCluster := sectorsPerCluster * bytesPerSector
+	clustersFor := func(bytes int64) int64 {
+		n := (bytes + bytesPerCluster - 1) / bytesPerCluster
+		if n == 0 {
+			n = 1
+		}
+		return n
+	}
+
+	used := int64(0)
+	for _, size := range files {
+		used += clustersFor(size)
+	}
+	for p, n := range slots {
+		if p != "." {
+			used += clustersFor(n * 32)
+		}
+	}
+
+	l := Layout{Type: t, BytesPerSector: bytesPerSector, BytesPerCluster: bytesPerCluster}
+	reserved := int64(1)
+	rootSectors := int64(0)
+	if t == FAT32 {
+		//the root directory is a chain in the data region, after the boot sector, FSInfo and backup boot sector
+		reserved = 32
+		used += clustersFor(slots["."] * 32)
+	} else {
+		entriesPerSector := bytesPerSector / 32
+		rootEntries := slots["."]
+		if rootEntries < int64(opts.RootEntries) {
+			rootEntries = int64(opts.RootEntries)
+		}
+		rootSectors = (rootEntries + entriesPerSector - 1) / entriesPerSector
+		if rootSectors == 0 {
+			rootSectors = 1
+		}
+		l.RootEntries = rootSectors * entriesPerSector
+		if l.RootEntries > 0xFFFF {
+			return l, false
+		}
+	}
+
+	clusters := used + (used*opts.SlackPercent+99)/100 + (opts.SlackBytes+bytesPerCluster-1)/bytesPerCluster
+	minClusters, maxClusters := t.clusterRange()
+	if clusters < minClusters {
+		clusters = minClusters
+	}
+	if clusters > maxClusters {
+		return l, false
+	}
+	sectorsPerFat := (t.fatBytes(clusters) + bytesPerSector - 1) / bytesPerSector
+	if t != FAT32 && sectorsPerFat > 0xFFFF {
+		return l, false
+	}
+	l.TotalSectors = reserved + 2*sectorsPerFat + rootSectors + clusters*sectorsPerCluster
+	if l.TotalSectors > 0xFFFFFFFF {
+		return l, false
+	}
+	l.SectorsPerFat = sectorsPerFat
+	l.Clusters = clusters
+	l.UsedClusters = used
+	l.FreeClusters = clusters - used
+	l.FreeBytes = l.FreeClusters * bytesPerCluster
+
+	//the formatter only makes FAT16 volumes
+	if t == FAT16 {
+		l.Args = DefaultFat16Args
+		l.Args.BytesPerSector = opts.BytesPerSector
+		l.Args.SectorsPerCluster = uint8(sectorsPerCluster)
+		l.Args.ReservedSectors = uint16(reserved)
+		l.Args.NumberOfFats = 2
+		l.Args.NumberOfRootEntries = uint16(l.RootEntries)
+		l.Args.SectorsPerFat = uint16(sectorsPerFat)
+	}
+	return l, true
+}
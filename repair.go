@@ -0,0 +1,636 @@
+package lipid
+
+import (
+	"errors"
+	"strconv"
+)
+
+//options for Repair
+type RepairOptions struct {
+	DryRun  bool //only list the changes, write nothing
+	FatCopy int  //FAT copy treated as good, every other copy is overwritten with it
+}
+
+//a change made by Repair, or planned when running dry
+type RepairAction struct {
+	Problem CheckProblem
+	Path    string
+	Detail  string
+}
+
+func (a RepairAction) String() string {
+	s := a.Problem.String()
+	if a.Path != "" {
+		s += " at " + a.Path
+	}
+	return s + ": " + a.Detail
+}
+
+//working state of a repair, every change is staged here until it is written
+type repairState struct {
+	f        *fat16
+	s        *checkState
+	fat      []uint16         //FAT being repaired
+	slots    map[int64][]byte //changed directory entries, by offset
+	clusters map[int64][]byte //changed data clusters, by cluster number
+	actions  []RepairAction
+	nextFree int64 //where to start looking for a free cluster
+}
+
+//fix the inconsistencies Check reports and return the changes made
+func (f *fat16) Repair(opts RepairOptions) ([]RepairAction, error) {
+	if opts.FatCopy < 0 || opts.FatCopy >= int(f.BPB.FatCopies) {
+		return nil, errors.New("FAT copy " + strconv.Itoa(opts.FatCopy) + " does not exist, the volume has " + strconv.Itoa(int(f.BPB.FatCopies)) + " copies")
+	}
+	s, err := f.scan(opts.FatCopy)
+	if err != nil {
+		return nil, err
+	}
+	r := &repairState{
+		f:        f,
+		s:        s,
+		fat:      append([]uint16(nil), s.fat...),
+		slots:    make(map[int64][]byte),
+		clusters: make(map[int64][]byte),
+		nextFree: 2,
+	}
+
+	for i := range s.entries {
+		err := r.fixChain(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.fixLfn()
+	if err != nil {
+		return nil, err
+	}
+	err = r.fixDots()
+	if err != nil {
+		return nil, err
+	}
+	err = r.saveLostChains()
+	if err != nil {
+		return nil, err
+	}
+	r.syncFats(opts.FatCopy)
+
+	if opts.DryRun {
+		return r.actions, nil
+	}
+	return r.actions, r.write()
+}
+
+func (r *repairState) act(problem CheckProblem, path string, detail string) {
+	r.actions = append(r.actions, RepairAction{problem, path, detail})
+}
+
+//read a directory entry, including staged changes
+func (r *repairState) readSlot(offset int64) ([]byte, error) {
+	if b, ok := r.slots[offset]; ok {
+		return b, nil
+	}
+	b, err := readBytes(r.f.dev, offset, 32, false)
+	if err != nil {
+		return nil, err
+	}
+	r.slots[offset] = b
+	return b, nil
+}
+
+//read a data cluster, including staged changes
+func (r *repairState) readCluster(cluster int64) ([]byte, error) {
+	if b, ok := r.clusters[cluster]; ok {
+		return b, nil
+	}
+	return readBytes(r.f.dev, r.f.GetClusterOffset(cluster), r.f.CommonSizes.BytesPerCluster, false)
+}
+
+//take a free cluster and mark it as end of chain, returns 0 if the volume is full
+func (r *repairState) allocate() int64 {
+	for ; r.nextFree <= r.s.maxCluster; r.nextFree++ {
+		if r.fat[r.nextFree] == 0x0000 && r.s.owner[r.nextFree] == 0 && !r.s.lost[r.nextFree] {
+			c := r.nextFree
+			r.fat[c] = 0xFFFF
+			r.nextFree++
+			return c
+		}
+	}
+	return 0
+}
+
+//mark a run of directory entries as deleted
+func (r *repairState) deleteSlots(offsets []int64) error {
+	for _, o := range offsets {
+		b, err := r.readSlot(o)
+		if err != nil {
+			return err
+		}
+		b[0] = 0xE5
+	}
+	return nil
+}
+
+//fix the chain and size of one entry
+func (r *repairState) fixChain(index int) error {
+	e := &r.s.entries[index]
+	chain := e.Chain
+
+	//the first cluster already belongs to another entry, a file gets a copy of the whole chain from there
+	owner := 0
+	if len(chain) == 0 && r.s.linkType(e.Start) == 1 {
+		owner = r.s.owner[e.Start]
+	}
+	if owner != 0 && !e.IsDir {
+		copied, err := r.copyTail(0, e.Start)
+		if err != nil {
+			return err
+		}
+		if len(copied) > 0 {
+			r.act(ProblemCrossLink, e.Path, "copy "+strconv.Itoa(len(copied))+" clusters shared with "+r.s.entries[owner-1].Path+" starting at cluster "+strconv.FormatInt(e.Start, 10))
+			err := r.setEntry(e, copied[0], e.Size)
+			if err != nil {
+				return err
+			}
+			chain = copied
+		}
+	}
+
+	//nothing usable, a directory cannot be saved and a file becomes empty
+	if len(chain) == 0 {
+		if e.IsDir {
+			if owner != 0 {
+				//copying a directory would cross-link everything in it, its clusters stay with the entry owning them
+				r.act(ProblemCrossLink, e.Path, "delete directory entry whose clusters belong to "+r.s.entries[owner-1].Path)
+			} else {
+				r.act(ProblemInvalidCluster, e.Path, "delete directory entry without usable clusters")
+			}
+			return r.deleteSlots(e.Slots)
+		}
+		if e.Start == 0 && e.Size == 0 {
+			return nil
+		}
+		r.act(ProblemInvalidCluster, e.Path, "truncate to 0 bytes")
+		return r.setEntry(e, 0, 0)
+	}
+
+	last := chain[len(chain)-1]
+	next := int64(r.fat[last])
+	if r.s.linkType(next) == 1 {
+		owner := r.s.owner[next]
+		if owner == 0 {
+			//the walk stopped at a free cluster
+			r.act(ProblemFreeCluster, e.Path, "end chain at cluster "+strconv.FormatInt(last, 10))
+			r.fat[last] = 0xFFFF
+		} else if owner == index+1 {
+			//the walk stopped because the chain loops
+			r.act(ProblemChainLoop, e.Path, "end chain at cluster "+strconv.FormatInt(last, 10))
+			r.fat[last] = 0xFFFF
+		} else if e.IsDir {
+			//copying a directory would cross-link everything in it
+			r.act(ProblemCrossLink, e.Path, "end chain at cluster "+strconv.FormatInt(last, 10)+" before cluster shared with "+r.s.entries[owner-1].Path)
+			r.fat[last] = 0xFFFF
+		} else {
+			copied, err := r.copyTail(last, next)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, copied...)
+			r.act(ProblemCrossLink, e.Path, "copy "+strconv.Itoa(len(copied))+" shared clusters starting at cluster "+strconv.FormatInt(next, 10))
+		}
+	} else if r.s.linkType(next) != 2 {
+		r.act(ProblemInvalidCluster, e.Path, "end chain at cluster "+strconv.FormatInt(last, 10)+" instead of 0x"+strconv.FormatInt(next, 16))
+		r.fat[last] = 0xFFFF
+	}
+	e.Chain = chain
+
+	if e.IsDir {
+		return nil
+	}
+	//make the size match the chain, files made by MakeEmptyFile own one cluster with a size of 0
+	length := int64(len(chain))
+	bytesPerCluster := r.s.bytesPerCluster
+	expected := (e.Size + bytesPerCluster - 1) / bytesPerCluster
+	if (e.Size == 0 && length == 1) || expected == length {
+		return nil
+	}
+	size := length * bytesPerCluster
+	if length < expected {
+		r.act(ProblemShortChain, e.Path, "truncate size from "+strconv.FormatInt(e.Size, 10)+" to "+strconv.FormatInt(size, 10)+" bytes")
+	} else {
+		r.act(ProblemLongChain, e.Path, "extend size from "+strconv.FormatInt(e.Size, 10)+" to "+strconv.FormatInt(size, 10)+" bytes")
+	}
+	return r.setEntry(e, e.Start, size)
+}
+
+//copy the chain starting at cluster into new clusters, linking them after prev or as a chain of their own if prev is 0
+func (r *repairState) copyTail(prev int64, cluster int64) ([]int64, error) {
+	copied := make([]int64, 0)
+	visited := make(map[int64]bool)
+	for r.s.linkType(cluster) == 1 && !visited[cluster] {
+		visited[cluster] = true
+		newCluster := r.allocate()
+		if newCluster == 0 {
+			r.act(ProblemCrossLink, "", "volume is full, chain ends after "+strconv.Itoa(len(copied))+" copied clusters")
+			break
+		}
+		data, err := r.readCluster(cluster)
+		if err != nil {
+			return nil, err
+		}
+		r.clusters[newCluster] = append([]byte(nil), data...)
+		if prev != 0 {
+			r.fat[prev] = uint16(newCluster)
+		}
+		copied = append(copied, newCluster)
+		prev = newCluster
+		cluster = int64(r.fat[cluster])
+	}
+	if prev != 0 {
+		r.fat[prev] = 0xFFFF
+	}
+	return copied, nil
+}
+
+//change the starting cluster and size of an entry
+func (r *repairState) setEntry(e *checkEntry, start int64, size int64) error {
+	b, err := r.readSlot(e.Offset)
+	if err != nil {
+		return err
+	}
+	b[0x1A] = byte(start & 0x00FF)
+	b[0x1B] = byte((start & 0xFF00) >> 8)
+	b[0x1C] = byte(size & 0x000000FF)
+	b[0x1D] = byte((size & 0x0000FF00) >> 8)
+	b[0x1E] = byte((size & 0x00FF0000) >> 16)
+	b[0x1F] = byte((size & 0xFF000000) >> 24)
+	e.Start = start
+	e.Size = size
+	return nil
+}
+
+//delete LFN runs that belong to no short entry
+func (r *repairState) fixLfn() error {
+	for _, run := range r.s.badLfn {
+		r.act(run.Problem, "", "delete "+strconv.Itoa(len(run.Slots))+" LFN entries at offset 0x"+strconv.FormatInt(run.Slots[0], 16))
+		err := r.deleteSlots(run.Slots)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//make sure every subdirectory starts with correct '.' and '..' entries, and root has none
+func (r *repairState) fixDots() error {
+	rootSlots := make([]int64, 0)
+	for i := int64(0); i < r.f.RegionOffsets.RootDirRegion.Length; i += 32 {
+		rootSlots = append(rootSlots, r.f.RegionOffsets.RootDirRegion.Offset+i)
+	}
+	err := r.removeDots(rootSlots, "", 0)
+	if err != nil {
+		return err
+	}
+
+	for i := range r.s.entries {
+		e := &r.s.entries[i]
+		if !e.IsDir || len(e.Chain) == 0 || r.s.owner[e.Chain[0]] != i+1 {
+			continue
+		}
+		//slots of the whole directory
+		dirSlots := make([]int64, 0)
+		for _, c := range e.Chain {
+			offset := r.f.GetClusterOffset(c)
+			for j := int64(0); j < r.s.bytesPerCluster; j += 32 {
+				dirSlots = append(dirSlots, offset+j)
+			}
+		}
+		if len(dirSlots) < 2 {
+			continue
+		}
+
+		//entry the dot entries copy their timestamps from
+		parentEntry, err := r.readSlot(e.Offset)
+		if err != nil {
+			return err
+		}
+		for position, name := range []string{".", ".."} {
+			want := e.Start
+			if name == ".." {
+				want = e.Parent
+			}
+			b, err := r.readSlot(dirSlots[position])
+			if err != nil {
+				return err
+			}
+			if isDotEntry(b, name) && b[0x0B]&0x10 == 0x10 && int64(b[0x1A])|int64(b[0x1B])<<8 == want {
+				continue
+			}
+			//move whatever real entry is in the way
+			if !(b[0] == 0x00 || b[0] == 0xE5 || isDotEntry(b, ".") || isDotEntry(b, "..")) {
+				moved, err := r.moveRun(dirSlots, position)
+				if err != nil {
+					return err
+				}
+				if !moved {
+					r.act(ProblemBadDotEntry, e.Path, "no free entry to move the entry in slot "+strconv.Itoa(position)+" to")
+					continue
+				}
+			}
+			dot := make([]byte, 32)
+			copy(dot, []byte(name + "          ")[:11])
+			dot[0x0B] = 0x10
+			copy(dot[0x0D:0x1A], parentEntry[0x0D:0x1A])
+			dot[0x1A] = byte(want & 0x00FF)
+			dot[0x1B] = byte((want & 0xFF00) >> 8)
+			copy(b, dot)
+			r.act(ProblemBadDotEntry, e.Path, "rebuild "+name+" entry pointing to cluster "+strconv.FormatInt(want, 10))
+		}
+		err = r.removeDots(dirSlots[2:], e.Path, 2)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//delete stray '.' and '..' entries
+func (r *repairState) removeDots(slots []int64, path string, first int) error {
+	for n, o := range slots {
+		b, err := r.readSlot(o)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0x00 {
+			break
+		}
+		if b[0x0B] != 0x0F && (isDotEntry(b, ".") || isDotEntry(b, "..")) {
+			r.act(ProblemBadDotEntry, path+"/", "delete stray dot entry in slot "+strconv.Itoa(n+first))
+			b[0] = 0xE5
+		}
+	}
+	return nil
+}
+
+//move the entry run covering slot position to free slots after the dot entries
+func (r *repairState) moveRun(dirSlots []int64, position int) (bool, error) {
+	//find the run (LFN entries and their short entry) covering the slot
+	start := position
+	for start > 0 {
+		b, err := r.readSlot(dirSlots[start])
+		if err != nil {
+			return false, err
+		}
+		if b[0x0B] == 0x0F && b[0]&0x40 == 0x40 {
+			break
+		}
+		prev, err := r.readSlot(dirSlots[start-1])
+		if err != nil {
+			return false, err
+		}
+		if prev[0x0B] != 0x0F || prev[0] == 0xE5 {
+			break
+		}
+		start--
+	}
+	end := position
+	for end < len(dirSlots)-1 {
+		b, err := r.readSlot(dirSlots[end])
+		if err != nil {
+			return false, err
+		}
+		if b[0x0B] != 0x0F {
+			break
+		}
+		end++
+	}
+	length := end - start + 1
+
+	//find room for it
+	for i := 2; i+length <= len(dirSlots); i++ {
+		free := true
+		for j := 0; j < length; j++ {
+			b, err := r.readSlot(dirSlots[i+j])
+			if err != nil {
+				return false, err
+			}
+			if !(b[0] == 0x00 || b[0] == 0xE5) {
+				free = false
+				break
+			}
+		}
+		if !free {
+			continue
+		}
+		//entries after the end marker would be hidden, so mark the skipped slots deleted
+		for j := 2; j < i; j++ {
+			b, err := r.readSlot(dirSlots[j])
+			if err != nil {
+				return false, err
+			}
+			if b[0] == 0x00 {
+				b[0] = 0xE5
+			}
+		}
+		for j := 0; j < length; j++ {
+			from, err := r.readSlot(dirSlots[start+j])
+			if err != nil {
+				return false, err
+			}
+			to, err := r.readSlot(dirSlots[i+j])
+			if err != nil {
+				return false, err
+			}
+			copy(to, from)
+			from[0] = 0xE5
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+//true if a directory entry has the given dot name
+func isDotEntry(b []byte, name string) bool {
+	return string(b[:11]) == (name + "          ")[:11]
+}
+
+//save every lost chain as FOUND.nnn/FILEnnnn.CHK
+func (r *repairState) saveLostChains() error {
+	if len(r.s.lostHeads) == 0 {
+		return nil
+	}
+
+	//end every lost chain cleanly
+	visited := make(map[int64]bool)
+	sizes := make([]int64, 0, len(r.s.lostHeads))
+	for _, head := range r.s.lostHeads {
+		length := int64(0)
+		c := head
+		for {
+			visited[c] = true
+			length++
+			next := int64(r.fat[c])
+			if r.s.linkType(next) == 1 && r.s.lost[next] && !visited[next] {
+				c = next
+				continue
+			}
+			if r.s.linkType(next) != 2 {
+				r.fat[c] = 0xFFFF
+			}
+			break
+		}
+		sizes = append(sizes, length*r.s.bytesPerCluster)
+	}
+
+	//find free FOUND.nnn names and root entries for them
+	rootOffset := r.f.RegionOffsets.RootDirRegion.Offset
+	rootSlots := make([]int64, 0)
+	used := make(map[string]bool)
+	for i := int64(0); i < r.f.RegionOffsets.RootDirRegion.Length; i += 32 {
+		b, err := r.readSlot(rootOffset + i)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0x00 || b[0] == 0xE5 {
+			rootSlots = append(rootSlots, rootOffset+i)
+			continue
+		}
+		used[string(b[:11])] = true
+	}
+	dirNames := make([]string, 0)
+	for n := 0; n < 1000; n++ {
+		candidate := "FOUND   " + padNumber(n, 3)
+		if !used[candidate] {
+			dirNames = append(dirNames, candidate)
+		}
+	}
+
+	//FILE0000.CHK to FILE9999.CHK fill a directory, the lost chains after them go to the next FOUND.nnn
+	for first := 0; first < len(sizes); first += maxFoundFiles {
+		last := first + maxFoundFiles
+		if last > len(sizes) {
+			last = len(sizes)
+		}
+		dir := first / maxFoundFiles
+		if dir >= len(rootSlots) || dir >= len(dirNames) {
+			r.act(ProblemLostChain, "", "no free root entry to save "+strconv.Itoa(len(sizes)-first)+" lost chains, leaving them allocated")
+			return nil
+		}
+		saved, err := r.saveFoundDir(dirNames[dir], rootSlots[dir], r.s.lostHeads[first:last], sizes[first:last])
+		if err != nil || !saved {
+			return err
+		}
+	}
+	return nil
+}
+
+//most lost chains saved in one FOUND.nnn directory, FILEnnnn has room for four digits
+const maxFoundFiles = 10000
+
+//make the directory dirName in the root entry at rootSlot holding the lost chains starting at heads,
+//false if there was no room for it and the chains were left allocated
+func (r *repairState) saveFoundDir(dirName string, rootSlot int64, heads []int64, sizes []int64) (bool, error) {
+	path := "/" + dirName[:5] + "." + dirName[8:]
+
+	//allocate the directory
+	slotsNeeded := int64(len(sizes) + 2)
+	clustersNeeded := (slotsNeeded*32 + r.s.bytesPerCluster - 1) / r.s.bytesPerCluster
+	dirChain := make([]int64, 0, clustersNeeded)
+	for i := int64(0); i < clustersNeeded; i++ {
+		c := r.allocate()
+		if c == 0 {
+			for _, d := range dirChain {
+				r.fat[d] = 0x0000
+			}
+			r.act(ProblemLostChain, "", "no free cluster for "+path+", leaving lost chains allocated")
+			return false, nil
+		}
+		if len(dirChain) > 0 {
+			r.fat[dirChain[len(dirChain)-1]] = uint16(c)
+		}
+		dirChain = append(dirChain, c)
+	}
+	dirData := make([]byte, clustersNeeded*r.s.bytesPerCluster)
+
+	entry := func(name string, attr byte, start int64, size int64) []byte {
+		b := make([]byte, 32)
+		copy(b, []byte(name))
+		b[0x0B] = attr
+		//creation, last access and last write dates
+		b[0x11] = 0x21
+		b[0x13] = 0x21
+		b[0x19] = 0x21
+		b[0x1A] = byte(start & 0x00FF)
+		b[0x1B] = byte((start & 0xFF00) >> 8)
+		b[0x1C] = byte(size & 0x000000FF)
+		b[0x1D] = byte((size & 0x0000FF00) >> 8)
+		b[0x1E] = byte((size & 0x00FF0000) >> 16)
+		b[0x1F] = byte((size & 0xFF000000) >> 24)
+		return b
+	}
+	copy(dirData[0:], entry(".          ", 0x10, dirChain[0], 0))
+	copy(dirData[32:], entry("..         ", 0x10, 0, 0))
+	for i, head := range heads {
+		name := "FILE" + padNumber(i, 4) + "CHK"
+		copy(dirData[(i+2)*32:], entry(name, 0x20, head, sizes[i]))
+		r.act(ProblemLostChain, path+"/FILE"+padNumber(i, 4)+".CHK", "save "+strconv.FormatInt(sizes[i]/r.s.bytesPerCluster, 10)+" lost clusters starting at cluster "+strconv.FormatInt(head, 10))
+	}
+	for i, c := range dirChain {
+		r.clusters[c] = dirData[int64(i)*r.s.bytesPerCluster : int64(i+1)*r.s.bytesPerCluster]
+	}
+	rootEntry, err := r.readSlot(rootSlot)
+	if err != nil {
+		return false, err
+	}
+	copy(rootEntry, entry(dirName, 0x10, dirChain[0], 0))
+	return true, nil
+}
+
+//left pad a number with zeros
+func padNumber(n int, width int) string {
+	s := strconv.Itoa(n)
+	for len(s) < width {
+		s = "0" + s
+	}
+	return s
+}
+
+//note FAT copies that will be overwritten
+func (r *repairState) syncFats(good int) {
+	for i, table := range r.s.fats {
+		if i == good {
+			continue
+		}
+		for j := range table {
+			if table[j] != r.s.fat[j] {
+				r.act(ProblemFatMismatch, "", "overwrite FAT "+strconv.Itoa(i)+" with FAT "+strconv.Itoa(good))
+				break
+			}
+		}
+	}
+}
+
+//write every staged change: data first, then directory entries, then the FATs
+func (r *repairState) write() error {
+	for c, data := range r.clusters {
+		err := writeBytes(r.f.dev, data, r.f.GetClusterOffset(c))
+		if err != nil {
+			return err
+		}
+	}
+	for offset, b := range r.slots {
+		err := r.f.writeEntryBytes(b, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	//every copy gets the repaired FAT
+	for c, v := range r.fat {
+		r.f.setFatEntry(int64(c), int64(v))
+	}
+	for i := range r.f.fatDirty {
+		r.f.fatDirty[i] = true
+	}
+	return r.f.Flush()
+}
@@ -0,0 +1,62 @@
+package lipid
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+)
+
+//time stamped on everything in reproducible mode: SOURCE_DATE_EPOCH if it is set, the FAT epoch of 1980-01-01 otherwise, in UTC
+func ReproducibleTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("SOURCE_DATE_EPOCH " + epoch + " is not a number of seconds")
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+//make later changes to the image reproducible, so the same changes made in the same order to the same image give the same bytes:
+//every timestamp is ReproducibleTime, clusters are allocated first fit from the start of the volume and the bytes past the end
+//of a file are always zeroed. Turning it off goes back to the real time, the allocation policy stays FirstFit until SetAllocPolicy
+func (f *fat16) SetReproducible(on bool) error {
+	if !on {
+		f.reproducible = false
+		return nil
+	}
+	t, err := ReproducibleTime()
+	if err != nil {
+		return err
+	}
+	err = f.SetAllocPolicy(FirstFit)
+	if err != nil {
+		return err
+	}
+	f.alloc.cursor = 2
+	f.reproducible = true
+	f.fixedTime = t
+	return nil
+}
+
+//time to stamp on entries being written
+func (f *fat16) now() time.Time {
+	if f.reproducible {
+		return f.fixedTime
+	}
+	return time.Now()
+}
+
+//serial number for a new volume, derived from the time of formatting like DOS does, or in reproducible mode from the layout and label
+func volumeSerial(totalSectors int64, args fatArgs, now time.Time) uint32 {
+	if !args.Reproducible {
+		return uint32(now.Unix()) ^ uint32(now.Nanosecond())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.FormatInt(totalSectors, 10) + "/" + strconv.Itoa(int(args.SectorsPerCluster)) + "/" + args.VolumeLabel + "/" + strconv.FormatInt(now.Unix(), 10)))
+	return h.Sum32()
+}
@@ -0,0 +1,298 @@
+package lipid
+
+import (
+	"errors"
+	"strconv"
+)
+
+//a short entry pointing at a cluster: a file or directory entry, or a '.' or '..' entry
+type clusterRef struct {
+	offset int64
+	start  int64
+}
+
+//grow or shrink the volume to newTotalSectors, keeping the cluster size and root directory size. The FAT is resized to fit,
+//moving the root directory and data region when its size changes. Shrinking first moves every cluster in use past the new end
+//into free clusters before it and fixes the chains and entries pointing at them, then truncates the image file
+func (f *fat16) Resize(newTotalSectors int64) error {
+	oldTotalSectors := f.BPB.TotalSectors()
+	if newTotalSectors == oldTotalSectors {
+		return nil
+	}
+	if newTotalSectors <= 0 || newTotalSectors > 0xFFFFFFFF {
+		return errors.New(strconv.FormatInt(newTotalSectors, 10) + " sectors is not a valid volume size")
+	}
+	args, err := completeFat16Args(newTotalSectors, fatArgs{
+		BytesPerSector:      f.BPB.BytesPerSector,
+		SectorsPerCluster:   f.BPB.SectorsPerCluster,
+		ReservedSectors:     f.BPB.ReservedSectors,
+		NumberOfFats:        f.BPB.FatCopies,
+		NumberOfRootEntries: f.BPB.RootEntries,
+	})
+	if err != nil {
+		return err
+	}
+	if args.NumberOfRootEntries != f.BPB.RootEntries {
+		return errors.New("root directory of " + strconv.Itoa(int(f.BPB.RootEntries)) + " entries does not fill whole sectors")
+	}
+
+	bytesPerSector := f.CommonSizes.BytesPerSector
+	bytesPerCluster := f.CommonSizes.BytesPerCluster
+	oldMax := f.maxCluster()
+	newMax := fat16DataSectors(newTotalSectors, args)/int64(args.SectorsPerCluster) + 1
+	//root directory and data region move together when the FATs change size
+	shift := int64(args.NumberOfFats) * (int64(args.SectorsPerFat) - f.CommonSizes.SectorsPerFat) * bytesPerSector
+
+	//find everything pointing at a starting cluster before anything moves
+	refs := make([]clusterRef, 0)
+	err = f.collectRefs(0, &refs, make(map[int64]bool))
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	if newTotalSectors > oldTotalSectors {
+		err := f.resizeFile(newTotalSectors * bytesPerSector)
+		if err != nil {
+			return err
+		}
+	}
+
+	//clusters past the new end go to free clusters before it
+	moved := make(map[int64]int64)
+	if newMax < oldMax {
+		moved, err = f.relocateClusters(newMax, refs)
+		if err != nil {
+			return err
+		}
+	}
+
+	//highest cluster still in use, the data after it does not need to move
+	last := int64(1)
+	for c := int64(2); c <= oldMax && c <= newMax; c++ {
+		if v := f.getFatEntry(c); v != fat16Free && v != fat16Bad {
+			last = c
+		}
+	}
+
+	//the FAT as it will be: entries past the old end start out free and entries past the new end are dropped
+	newFat := make([]uint16, int64(args.SectorsPerFat)*bytesPerSector/2)
+	copy(newFat[:2], f.fat[:2])
+	for c := int64(2); c <= newMax && c <= oldMax; c++ {
+		newFat[c] = uint16(f.getFatEntry(c))
+	}
+
+	if shift != 0 {
+		rootOffset := f.RegionOffsets.RootDirRegion.Offset
+		length := f.RegionOffsets.RootDirRegion.Length + (last-1)*bytesPerCluster
+		err := f.moveBytes(rootOffset, rootOffset+shift, length)
+		if err != nil {
+			return err
+		}
+	}
+	currentDir := f.CurrentDirOffset
+	if c, ok := moved[f.clusterAt(currentDir)]; ok {
+		currentDir = f.GetClusterOffset(c) + (currentDir-f.RegionOffsets.DataRegion.Offset)%bytesPerCluster
+	}
+
+	//write every FAT copy at its new place
+	fatLength := int64(args.SectorsPerFat) * bytesPerSector
+	raw := make([]byte, fatLength)
+	for i, v := range newFat {
+		raw[i*2] = byte(v & 0x00FF)
+		raw[i*2+1] = byte((v & 0xFF00) >> 8)
+	}
+	for n := int64(0); n < int64(args.NumberOfFats); n++ {
+		err := writeBytes(f.dev, raw, f.RegionOffsets.FATRegion.Offset+n*fatLength)
+		if err != nil {
+			return err
+		}
+	}
+
+	//boot sector, with the sector count in whichever field fits it
+	small, large := newTotalSectors, int64(0)
+	if newTotalSectors >= 0x10000 {
+		small, large = 0, newTotalSectors
+	}
+	for _, field := range []struct {
+		o     offsetObject
+		value int64
+	}{
+		{BootSector.SmallSectors, small},
+		{BootSector.LargeSectors, large},
+		{BootSector.SectorsPerFat, int64(args.SectorsPerFat)},
+	} {
+		b := make([]byte, field.o.Length)
+		for i := range b {
+			b[i] = byte(field.value >> (8 * uint(i)))
+		}
+		err := writeBytes(f.dev, b, field.o.Offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	//take on the new geometry
+	f.BPB.SmallSectors = uint16(small)
+	f.BPB.LargeSectors = uint32(large)
+	f.BPB.SectorsPerFat = args.SectorsPerFat
+	f.CommonSizes.SectorsPerFat = int64(args.SectorsPerFat)
+	f.RegionOffsets = getRegionData(f.BPB)
+	f.CurrentDirOffset = currentDir + shift
+	f.fat = newFat
+	f.fatDirty = make([]bool, args.SectorsPerFat)
+	if f.alloc.cursor > newMax {
+		f.alloc.cursor = 2
+	}
+	f.buildFreeMap()
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	if newTotalSectors < oldTotalSectors {
+		return f.resizeFile(newTotalSectors * bytesPerSector)
+	}
+	return nil
+}
+
+//move every cluster in use past newMax to a free cluster at or before it, returns where each one went
+func (f *fat16) relocateClusters(newMax int64, refs []clusterRef) (map[int64]int64, error) {
+	oldMax := f.maxCluster()
+	old := append([]uint16(nil), f.fat...)
+	inUse := func(c int64) bool { return old[c] != uint16(fat16Free) && old[c] != uint16(fat16Bad) }
+
+	//pick the targets first, so a volume without room is left untouched
+	moved := make(map[int64]int64)
+	next := int64(2)
+	for c := newMax + 1; c <= oldMax; c++ {
+		if !inUse(c) {
+			continue
+		}
+		next = f.nextFree(next, newMax)
+		if next == -1 {
+			return nil, errors.New("not enough free space before cluster " + strconv.FormatInt(newMax+1, 10) + " to shrink the volume")
+		}
+		moved[c] = next
+		next++
+	}
+
+	//data first, then the entries pointing at moved chains, then the FAT
+	for c, d := range moved {
+		data, err := readBytes(f.dev, f.GetClusterOffset(c), f.CommonSizes.BytesPerCluster, false)
+		if err != nil {
+			return nil, err
+		}
+		err = writeBytes(f.dev, data, f.GetClusterOffset(d))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range refs {
+		d, ok := moved[r.start]
+		if !ok {
+			continue
+		}
+		offset := r.offset
+		//the entry itself may sit in a directory cluster that moved
+		if c, ok := moved[f.clusterAt(offset)]; ok {
+			offset = f.GetClusterOffset(c) + (offset-f.RegionOffsets.DataRegion.Offset)%f.CommonSizes.BytesPerCluster
+		}
+		err := f.setEntryStart(offset, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for c := int64(2); c <= oldMax; c++ {
+		if !inUse(c) {
+			continue
+		}
+		v := int64(old[c])
+		if d, ok := moved[v]; ok {
+			v = d
+		}
+		if d, ok := moved[c]; ok {
+			f.setFatEntry(d, v)
+			f.setFatEntry(c, fat16Free)
+		} else {
+			f.setFatEntry(c, v)
+		}
+	}
+	return moved, nil
+}
+
+//record every short entry under a directory that points at a cluster, dot entries included
+func (f *fat16) collectRefs(dirCluster int64, refs *[]clusterRef, visited map[int64]bool) error {
+	err := checkDirLoop(visited, dirCluster)
+	if err != nil {
+		return err
+	}
+	entries, err := f.readDir(dirCluster)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Start != 0 {
+			*refs = append(*refs, clusterRef{offset: e.Offset, start: e.Start})
+		}
+		if e.IsDir() && !e.IsDot() && e.Start != 0 {
+			err := f.collectRefs(e.Start, refs, visited)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//cluster holding the byte at offset, 0 outside the data region
+func (f *fat16) clusterAt(offset int64) int64 {
+	if offset < f.RegionOffsets.DataRegion.Offset {
+		return 0
+	}
+	return (offset-f.RegionOffsets.DataRegion.Offset)/f.CommonSizes.BytesPerCluster + 2
+}
+
+//copy length bytes from src to dst, the ranges may overlap
+func (f *fat16) moveBytes(src int64, dst int64, length int64) error {
+	chunk := f.CommonSizes.BytesPerCluster
+	for done := int64(0); done < length; done += chunk {
+		n := chunk
+		if n > length-done {
+			n = length - done
+		}
+		//copy from the end when moving up, so nothing is overwritten before it is read
+		at := done
+		if dst > src {
+			at = length - done - n
+		}
+		data, err := readBytes(f.dev, src+at, n, false)
+		if err != nil {
+			return err
+		}
+		err = writeBytes(f.dev, data, dst+at)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//truncate or extend the image file to size bytes, everything pending is written first
+func (f *fat16) resizeFile(size int64) error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.File.Truncate(size)
+	if err != nil {
+		return err
+	}
+	if c, ok := f.dev.(*blockCache); ok {
+		c.reset(size)
+	}
+	return nil
+}
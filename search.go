@@ -0,0 +1,196 @@
+package lipid
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+//test applied to entries by Find
+type Predicate func(EntryInfo) bool
+
+//paths of the entries matching pattern; names match ignoring case on either the long or the short name, '**' matches any number of directories
+func (f *fat16) Glob(pattern string) ([]string, error) {
+	segments := make([]string, 0)
+	for _, s := range strings.Split(pattern, "/") {
+		if s == "" || s == "." {
+			continue
+		}
+		//reject malformed patterns before walking
+		_, err := path.Match(strings.ToLower(s), "")
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, strings.ToLower(s))
+	}
+	root := ""
+	if strings.HasPrefix(pattern, "/") {
+		root = "/"
+	}
+
+	matches := make([]string, 0)
+	//pattern positions reached by each directory visited so far
+	states := map[string][]int{root: globClosure(segments, []int{0})}
+	err := f.Walk(root, func(p string, e EntryInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		reached := globStep(segments, states[parentPath(p)], e)
+		if len(reached) == 0 {
+			//nothing under this directory can match
+			if e.IsDir() {
+				return SkipDir
+			}
+			return nil
+		}
+		for _, r := range reached {
+			if r == len(segments) {
+				matches = append(matches, p)
+				break
+			}
+		}
+		if e.IsDir() {
+			states[p] = reached
+		}
+		return nil
+	})
+	return matches, err
+}
+
+//path of the directory holding the entry at p
+func parentPath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i == -1 {
+		return ""
+	}
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+//pattern positions reached after matching an entry from the positions its directory reached
+func globStep(segments []string, from []int, e EntryInfo) []int {
+	long, short := strings.ToLower(e.Name), strings.ToLower(e.ShortName)
+	next := make([]int, 0)
+	for _, i := range from {
+		if i == len(segments) {
+			continue
+		}
+		if segments[i] == "**" {
+			next = append(next, i)
+			continue
+		}
+		if ok, _ := path.Match(segments[i], long); ok {
+			next = append(next, i+1)
+		} else if ok, _ := path.Match(segments[i], short); ok {
+			next = append(next, i+1)
+		}
+	}
+	return globClosure(segments, next)
+}
+
+//add the positions reached by letting '**' match nothing
+func globClosure(segments []string, positions []int) []int {
+	seen := make(map[int]bool)
+	closed := make([]int, 0, len(positions))
+	for len(positions) > 0 {
+		i := positions[0]
+		positions = positions[1:]
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		closed = append(closed, i)
+		if i < len(segments) && segments[i] == "**" {
+			positions = append(positions, i+1)
+		}
+	}
+	return closed
+}
+
+//every entry under root meeting all predicates, in directory order
+func (f *fat16) Find(root string, predicates ...Predicate) ([]EntryInfo, error) {
+	found := make([]EntryInfo, 0)
+	err := f.Walk(root, func(p string, e EntryInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.Offset == -1 || p == root {
+			return nil
+		}
+		for _, pred := range predicates {
+			if !pred(e) {
+				return nil
+			}
+		}
+		found = append(found, e)
+		return nil
+	})
+	return found, err
+}
+
+//name glob matching the long or the short name, ignoring case
+func NameMatches(pattern string) Predicate {
+	pattern = strings.ToLower(pattern)
+	return func(e EntryInfo) bool {
+		ok, _ := path.Match(pattern, strings.ToLower(e.Name))
+		if !ok {
+			ok, _ = path.Match(pattern, strings.ToLower(e.ShortName))
+		}
+		return ok
+	}
+}
+
+//files of at least size bytes
+func SizeAtLeast(size int64) Predicate {
+	return func(e EntryInfo) bool { return !e.IsDir() && e.Size >= size }
+}
+
+//files of at most size bytes
+func SizeAtMost(size int64) Predicate {
+	return func(e EntryInfo) bool { return !e.IsDir() && e.Size <= size }
+}
+
+//entries with every attribute bit of mask set
+func HasAttr(mask byte) Predicate {
+	return func(e EntryInfo) bool { return e.Attr&mask == mask }
+}
+
+//entries with none of the attribute bits of mask set
+func LacksAttr(mask byte) Predicate {
+	return func(e EntryInfo) bool { return e.Attr&mask == 0 }
+}
+
+//entries last written after t
+func ModifiedAfter(t time.Time) Predicate {
+	return func(e EntryInfo) bool { return e.Modified.After(t) }
+}
+
+//entries last written before t
+func ModifiedBefore(t time.Time) Predicate {
+	return func(e EntryInfo) bool { return e.Modified.Before(t) }
+}
+
+//entries created after t
+func CreatedAfter(t time.Time) Predicate {
+	return func(e EntryInfo) bool { return e.Created.After(t) }
+}
+
+//entries created before t
+func CreatedBefore(t time.Time) Predicate {
+	return func(e EntryInfo) bool { return e.Created.Before(t) }
+}
+
+//files only
+func IsFile() Predicate {
+	return func(e EntryInfo) bool { return !e.IsDir() }
+}
+
+//directories only
+func IsDirectory() Predicate {
+	return func(e EntryInfo) bool { return e.IsDir() }
+}
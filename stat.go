@@ -0,0 +1,145 @@
+package lipid
+
+import (
+	"strings"
+)
+
+//usage statistics of a volume
+type FsStats struct {
+	TotalClusters   int64
+	FreeClusters    int64
+	UsedClusters    int64
+	BadClusters     int64
+	BytesPerCluster int64
+	FreeBytes       int64
+	RootEntries     int64 //entries the root directory can hold
+	RootEntriesUsed int64 //entries in use, LFN entries and the volume label included
+	RootEntriesFree int64
+	VolumeLabel     string
+	VolumeSerial    uint32
+}
+
+//recursive usage of a directory tree
+type DirUsage struct {
+	Files          int64
+	Directories    int64 //subdirectories, not counting the directory itself
+	LogicalBytes   int64 //sum of the file sizes
+	AllocatedBytes int64 //clusters owned by the files and directories
+}
+
+//report free space and usage of the volume
+func (f *fat16) StatFS() (FsStats, error) {
+	stats := FsStats{
+		TotalClusters:   f.maxCluster() - 1,
+		BytesPerCluster: f.CommonSizes.BytesPerCluster,
+	}
+
+	//count FAT entries
+	for c := int64(2); c < stats.TotalClusters+2; c++ {
+		switch f.getFatEntry(c) {
+		case fat16Free:
+			stats.FreeClusters++
+		case fat16Bad:
+			stats.BadClusters++
+		default:
+			stats.UsedClusters++
+		}
+	}
+	stats.FreeBytes = stats.FreeClusters * stats.BytesPerCluster
+
+	//count root entries, the volume label entry wins over the one in the boot sector
+	label := ""
+	root, err := readBytes(f.dev, f.RegionOffsets.RootDirRegion.Offset, f.RegionOffsets.RootDirRegion.Length, false)
+	if err != nil {
+		return FsStats{}, err
+	}
+	stats.RootEntries = f.RegionOffsets.RootDirRegion.Length / 32
+	for i := int64(0); i < f.RegionOffsets.RootDirRegion.Length; i += 32 {
+		e := root[i : i+32]
+		if e[0] == 0x00 || e[0] == 0xE5 {
+			continue
+		}
+		stats.RootEntriesUsed++
+		if e[0x0B] != 0x0F && e[0x0B]&0x08 == 0x08 && label == "" {
+			label = string(e[:11])
+		}
+	}
+	stats.RootEntriesFree = stats.RootEntries - stats.RootEntriesUsed
+
+	//label and serial number are only valid with the extended boot signature
+	if f.BPB.ExtBootSig == 0x29 {
+		if label == "" {
+			label = f.BPB.VolumeLabel
+		}
+		stats.VolumeSerial = f.BPB.VolumeSerialNum
+	}
+	stats.VolumeLabel = strings.TrimRight(label, " ")
+
+	return stats, nil
+}
+
+//report the recursive size of the tree at path
+func (f *fat16) DiskUsage(path string) (DirUsage, error) {
+	entry, err := f.lookup(path)
+	if err != nil {
+		return DirUsage{}, err
+	}
+	usage := DirUsage{}
+	if !entry.IsDir() {
+		err = f.addUsage(&usage, entry)
+		return usage, err
+	}
+	if entry.Start != 0 {
+		chain, err := f.getChain(entry.Start)
+		if err != nil {
+			return DirUsage{}, err
+		}
+		usage.AllocatedBytes += int64(len(chain)) * f.CommonSizes.BytesPerCluster
+	}
+	err = f.dirUsage(&usage, entry.Start, make(map[int64]bool))
+	return usage, err
+}
+
+//add the usage of everything in a directory
+func (f *fat16) dirUsage(usage *DirUsage, dirCluster int64, visited map[int64]bool) error {
+	err := checkDirLoop(visited, dirCluster)
+	if err != nil {
+		return err
+	}
+	entries, err := f.readDir(dirCluster)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDot() {
+			continue
+		}
+		err := f.addUsage(usage, e)
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			err := f.dirUsage(usage, e.Start, visited)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//add the usage of a single entry
+func (f *fat16) addUsage(usage *DirUsage, e dirEntry) error {
+	chain, err := f.getChain(e.Start)
+	if err != nil {
+		return err
+	}
+	usage.AllocatedBytes += int64(len(chain)) * f.CommonSizes.BytesPerCluster
+	if e.IsDir() {
+		usage.Directories++
+	} else {
+		usage.Files++
+		usage.LogicalBytes += e.Size
+	}
+	return nil
+}
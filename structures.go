@@ -73,6 +73,8 @@ type fatArgs struct {
 	HiddenSectors       uint32
 	DriveNumber         byte
 	VolumeLabel         string
+	VolumeSerial        uint32 //0 derives one from the time of formatting
+	Reproducible        bool   //format and open the image in reproducible mode, see SetReproducible
 }
 
 var DefaultFat16Args = fatArgs{
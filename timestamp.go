@@ -0,0 +1,39 @@
+package lipid
+
+import (
+	"time"
+)
+
+//FAT date and time of t, clamped to the years FAT can store
+func fatDateTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, t.Location())
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, clock
+}
+
+//set the creation, last access and last write times of a short entry
+func stampEntry(e []byte, t time.Time) {
+	date, clock := fatDateTime(t)
+	//creation time in 10ms units on top of the 2 second resolution
+	e[0x0D] = byte((t.Second()%2)*100 + t.Nanosecond()/10000000)
+	e[0x0E], e[0x0F] = byte(clock&0x00FF), byte((clock&0xFF00)>>8)
+	e[0x10], e[0x11] = byte(date&0x00FF), byte((date&0xFF00)>>8)
+	e[0x12], e[0x13] = byte(date&0x00FF), byte((date&0xFF00)>>8)
+	e[0x16], e[0x17] = byte(clock&0x00FF), byte((clock&0xFF00)>>8)
+	e[0x18], e[0x19] = byte(date&0x00FF), byte((date&0xFF00)>>8)
+}
+
+//time stored as a FAT date and time, zero if the date is unset
+func fatTime(date uint16, clock uint16, tenths byte) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month((date>>5)&0x0F), int(date&0x1F),
+		int(clock>>11), int((clock>>5)&0x3F), int(clock&0x1F)*2+int(tenths)/100, int(tenths)%100*10000000, time.Local)
+}
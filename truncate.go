@@ -0,0 +1,138 @@
+package lipid
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+//grow or shrink the file at path to size bytes, new bytes read as zeros
+func (f *fat16) Truncate(path string, size int64) error {
+	if size < 0 || size > 0xFFFFFFFF {
+		return errors.New("size " + strconv.FormatInt(size, 10) + " is unsupported by FAT")
+	}
+	entry, err := f.lookup(path)
+	if err != nil {
+		return err
+	}
+	if entry.IsDir() {
+		return errors.New(path + " is a directory")
+	}
+	chain, err := f.getChain(entry.Start)
+	if err != nil {
+		return err
+	}
+
+	oldChainBytes := int64(len(chain)) * f.CommonSizes.BytesPerCluster
+	clusters := f.clustersFor(size)
+	switch {
+	case int64(len(chain)) > clusters:
+		//end the chain early and free the clusters after it
+		f.setFatEntry(chain[clusters-1], 0xFFFF)
+		f.freeChain(chain[clusters:])
+		chain = chain[:clusters]
+	case int64(len(chain)) < clusters:
+		added, err := f.extendChain(chain, clusters-int64(len(chain)))
+		if err != nil {
+			return err
+		}
+		for _, c := range added {
+			err := f.clearCluster(c)
+			if err != nil {
+				return err
+			}
+		}
+		chain = append(chain, added...)
+	}
+
+	//bytes past the new end of file keep old data, unless the image is reproducible
+	if size < entry.Size && f.reproducible {
+		err := f.zeroRange(chain, size, int64(len(chain))*f.CommonSizes.BytesPerCluster)
+		if err != nil {
+			return err
+		}
+	}
+	//bytes past the old end of file that were already allocated
+	if size > entry.Size && entry.Size < oldChainBytes {
+		end := size
+		if end > oldChainBytes {
+			end = oldChainBytes
+		}
+		err := f.zeroRange(chain, entry.Size, end)
+		if err != nil {
+			return err
+		}
+	}
+	return f.updateEntry(entry, chain[0], size)
+}
+
+//add everything read from r to the end of the file at path, returns the number of bytes added
+func (f *fat16) Append(path string, r io.Reader) (int64, error) {
+	entry, err := f.lookup(path)
+	if err != nil {
+		return 0, err
+	}
+	if entry.IsDir() {
+		return 0, errors.New(path + " is a directory")
+	}
+	chain, err := f.getChain(entry.Start)
+	if err != nil {
+		return 0, err
+	}
+
+	bytesPerCluster := f.CommonSizes.BytesPerCluster
+	size := entry.Size
+	buffer := make([]byte, bytesPerCluster)
+	var readErr error
+	for readErr == nil {
+		//fill the rest of the cluster holding the end of the file
+		within := size % bytesPerCluster
+		n, err := io.ReadFull(r, buffer[:bytesPerCluster-within])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			readErr = io.EOF
+		} else if err != nil {
+			readErr = err
+		}
+		if n == 0 {
+			break
+		}
+		if size+int64(n) > 0xFFFFFFFF {
+			readErr = errors.New(path + " would grow past 4GB, which is unsupported by FAT")
+			break
+		}
+
+		//the end of the file is at a cluster boundary, or the file has no clusters yet
+		if size/bytesPerCluster >= int64(len(chain)) {
+			added, err := f.extendChain(chain, 1)
+			if err != nil {
+				readErr = err
+				break
+			}
+			err = f.clearCluster(added[0])
+			if err != nil {
+				readErr = err
+				break
+			}
+			chain = append(chain, added...)
+		}
+
+		err = writeBytes(f.dev, buffer[:n], f.GetClusterOffset(chain[size/bytesPerCluster])+within)
+		if err != nil {
+			readErr = err
+			break
+		}
+		size += int64(n)
+	}
+	if readErr == io.EOF {
+		readErr = nil
+	}
+
+	//record whatever made it into the image, even if reading failed part way
+	if len(chain) > 0 {
+		err = f.updateEntry(entry, chain[0], size)
+		if err != nil {
+			return size - entry.Size, err
+		}
+	}
+	return size - entry.Size, readErr
+}
@@ -2,7 +2,6 @@ package lipid
 
 import (
 	"errors"
-	"os"
 	"strconv"
 	"strings"
 )
@@ -10,7 +9,7 @@ import (
 //takes dirOffset (offset of directory ENTRY, not cluster) and the path to follow
 func (f *fat16) findOffset(dirOffset int64, path string) int64 {
 	clusterNumberOffset := int64(0x1A + dirOffset)
-	clusterN := getValue(f.File, offsetObject{clusterNumberOffset, 2})
+	clusterN := getValue(f.dev, offsetObject{clusterNumberOffset, 2})
 
 	clusterSize := f.CommonSizes.BytesPerCluster
 
@@ -27,25 +26,25 @@ func (f *fat16) findOffset(dirOffset int64, path string) int64 {
 		off := clusterOffset + i
 
 		//check if entry has been deleted or is free
-		temp := getValue(f.File, offsetObject{off, 1})
+		temp := getValue(f.dev, offsetObject{off, 1})
 		if temp == 0xE5 || temp == 0x00 {
 			i += 32
 			continue
 		}
 
 		//check for LFN
-		if getValue(f.File, offsetObject{off + 0xB, 1}) == 0x0F {
+		if getValue(f.dev, offsetObject{off + 0xB, 1}) == 0x0F {
 			unicodeOffsets := fat16UnicodeReverseOffsets
 
 			reverseFileName := ""
-			lfnLength := getValue(f.File, offsetObject{off, 1}) & 0x3F
+			lfnLength := getValue(f.dev, offsetObject{off, 1}) & 0x3F
 			//go through each chain link in LFN chain
 			for j := int64(0); j < lfnLength; j++ {
 				//access each character offset
 				for _, o := range unicodeOffsets {
 					//calculate char offset
 					p := int64(j*32) + off + o
-					charBytes, _ := readBytes(f.File, p, 2, true)
+					charBytes, _ := readBytes(f.dev, p, 2, true)
 
 					r := rune(btoi64(&charBytes))
 					if r == 0xffff || r == 0 {
@@ -71,7 +70,7 @@ func (f *fat16) findOffset(dirOffset int64, path string) int64 {
 		} else {
 			//not a LFN
 			//read file name
-			byteArrayName, _ := readBytes(f.File, off, 8, false)
+			byteArrayName, _ := readBytes(f.dev, off, 8, false)
 			fileNameBytes := make([]byte, 0)
 
 			for j := range byteArrayName {
@@ -83,7 +82,7 @@ func (f *fat16) findOffset(dirOffset int64, path string) int64 {
 				}
 			}
 			//read file extension
-			byteArrayExt, _ := readBytes(f.File, off+8, 3, false)
+			byteArrayExt, _ := readBytes(f.dev, off+8, 3, false)
 			fileExtBytes := make([]byte, 0)
 
 			for j := range byteArrayExt {
@@ -182,8 +181,9 @@ func generateNameEntry(name string) []byte {
 		}
 		cSum := generateLfnChecksum(sumName)
 
+		//LFN entries are stored last part first, ordinal 1 sits right before the short entry
 		for e := 0; e < entries-1; e++ {
-			arrayOffset := int64(e * 32)
+			arrayOffset := int64((entries - 2 - e) * 32)
 			//add LFN flag
 			nameDataArray[arrayOffset+0x0B] = 0x0F
 			//add checksum
@@ -194,7 +194,7 @@ func generateNameEntry(name string) []byte {
 			//add characters
 			for i, o := range fat16UnicodeOffsets {
 				index := i + e*13
-				if !(index < len(name)) {
+				if !(index < len(lfnNameString)) {
 					nameDataArray[arrayOffset+o] = 0xFF
 					nameDataArray[arrayOffset+o+1] = 0xFF
 				} else {
@@ -231,6 +231,12 @@ func generateNameEntry(name string) []byte {
 
 //makes an entry
 func (f *fat16) makeEntry(name string) (int64, error) {
+	offset, _, err := f.makeChainEntry(name, allocRequest{clusters: 1})
+	return offset, err
+}
+
+//makes an entry owning a newly allocated chain
+func (f *fat16) makeChainEntry(name string, req allocRequest) (int64, []int64, error) {
 	//remove path seperator character if needed
 	if name[len(name)-1] == '/' {
 		name = name[:len(name)-1]
@@ -238,172 +244,62 @@ func (f *fat16) makeEntry(name string) (int64, error) {
 
 	//check if name has been provided
 	if name == "" {
-		return -1, errors.New("you need to specify an entry name")
+		return -1, nil, errors.New("you need to specify an entry name")
 	}
 
-	//CD TO PATH
-	//generate path name
-	sName := strings.Split(name, "/")
-	dirPathName := ""
-	if len(sName) > 1 {
-		for _, e := range sName[:len(sName)-1] {
-			dirPathName += e + "/"
-		}
-	} else {
-		dirPathName = sName[0]
+	//find the directory the entry goes in
+	dirCluster, err := f.parentCluster(name)
+	if err != nil {
+		return -1, nil, err
 	}
-
-	fileName := sName[len(sName)-1]
-	//get path dir offset
-	var workingDirOffset int64
-	if len(sName) > 1 && len(dirPathName) > 0 {
-		//get directory entry
-		temp, err := f.getPathOffset(dirPathName)
-		if err != nil {
-			return -1, errors.New(dirPathName + " is not a valid path")
-		}
-		//get offset of directory cluster
-		clusterOffset := getValue(f.File, offsetObject{temp + 0x1A, 2})
-		if clusterOffset == -1 {
-			return -1, errors.New("an unexpected error has occurred")
-		}
-		dirClusterOffset := f.GetClusterOffset(clusterOffset)
-		if dirClusterOffset == -1 {
-			return -1, errors.New("an unexpected error has occurred")
-		}
-		workingDirOffset = dirClusterOffset
-	} else {
-		workingDirOffset = f.CurrentDirOffset
+	fileName := name[strings.LastIndex(name, "/")+1:]
+	siblings, err := f.readDir(dirCluster)
+	if err != nil {
+		return -1, nil, err
 	}
 	//check if entry with this name already exists
-	if f.findOffset(workingDirOffset, fileName) != -1 {
-		return -1, errors.New("entry with this name already exists")
+	if fileName == "." || fileName == ".." || nameTaken(siblings, fileName) {
+		return -1, nil, errors.New("entry with this name already exists")
 	}
 
 	entryBytes := generateNameEntry(fileName)
 
-	regularName := ""
-	for i := len(entryBytes) - 32; i < len(entryBytes)-24; i++ {
-		if entryBytes[i] != 0x20 {
-			regularName += string(entryBytes[i])
-		}
-	}
-	regularExt := ""
-	for i := len(entryBytes) - 24; i < len(entryBytes)-21; i++ {
-		if entryBytes[i] != 0x20 {
-			regularExt += string(entryBytes[i])
-		}
-	}
-
 	//adjust non-lfn name as needed
-	temp := []byte(regularName)
-	tempExt := ""
-	if regularExt != "" {
-		tempExt = "." + regularExt
-	}
-
-	for f.findOffset(workingDirOffset, (string(temp)+tempExt)) != -1 {
-		//increase last character
-		temp[7] += 1
-		//check for rollover
-		if temp[7] == 0x3A {
-			temp[7] = '0'
-			temp[5] += 1
-		}
-		//check for rollover in all other characters
-		for i := 5; i > 0; i-- {
-			if temp[i] == 0x5B {
-				temp[i] = 'A'
-				temp[i-1] += 1
-			}
-		}
-		//check final character for rollover (entry cannot be created)
-		if temp[0] == 0x5B {
-			return -1, errors.New("could not create entry with this name")
-		}
-	}
-
-	//write adjusted name back to "nameEntry"
-	for i, c := range temp {
-		entryBytes[len(entryBytes)-32+i] = byte(c)
+	err = setFreeAlias(entryBytes, func(alias string) bool { return nameTaken(siblings, alias) })
+	if err != nil {
+		return -1, nil, err
 	}
 
-	//locate offset to insert
-	entries := len(entryBytes) / 32
-	//determine size of search region
-	var regionSize int64
-	if workingDirOffset == f.RegionOffsets.RootDirRegion.Offset {
-		regionSize = f.RegionOffsets.RootDirRegion.Length
-	} else {
-		regionSize = f.CommonSizes.BytesPerCluster
-	}
-
-	//look through cluster for location of entry
-	entryOffset := int64(-1)
-	for i := 0; i < int(regionSize); i += 32 {
-		found := true
-		off := workingDirOffset + int64(i)
-		//look for section with appropriate number of adjacent entries
-		for j := 0; j < entries; j++ {
-			//check if entry value is free
-			val := getValue(f.File, offsetObject{off + int64(j*32), 1})
-			if !(val == 0x00 || val == 0xE5) {
-				found = false
-				break
-			}
-		}
-		//entry is found
-		if found {
-			entryOffset = off
-			break
-		}
-	}
-	//no space found
-	if entryOffset == -1 {
-		return -1, errors.New("no space left in cluster")
+	//locate offsets to insert
+	slots, err := f.freeSlots(dirCluster, len(entryBytes)/32)
+	if err != nil {
+		return -1, nil, err
 	}
 
-	//find entry location in FAT
-	foundFatEntry := false
-	fatEntry := int64(3)
-	for i := int64(3); i*2 < f.RegionOffsets.FATRegion.Length; i++ {
-		if getValue(f.File, offsetObject{f.RegionOffsets.FATRegion.Offset + (i * 2), 2}) == 0x0000 {
-			foundFatEntry = true
-			break
-		}
-		fatEntry++
-	}
-	if !foundFatEntry {
-		return -1, errors.New("no space left in FAT")
+	//allocate the chain
+	chain, err := f.allocChain(req)
+	if err != nil {
+		return -1, nil, err
 	}
+	fatEntry := chain[0]
 
 	//update FAT first entry
 	entryBytes[len(entryBytes)-32+0x1A] = byte(fatEntry & 0x00FF)
 	entryBytes[len(entryBytes)-32+0x1B] = byte((fatEntry & 0xFF00) >> 8)
 
-	//set creation date
-	entryBytes[len(entryBytes)-32+0x11] = 0x21
-	//set last access date
-	entryBytes[len(entryBytes)-32+0x13] = 0x21
-	//set last write date
-	entryBytes[len(entryBytes)-32+0x19] = 0x21
-
-	//write name entry to cluster
-	err := writeBytes(f.File, entryBytes, entryOffset)
-	if err != nil {
-		return -1, err
-	}
+	//set creation, last access and last write dates
+	stampEntry(entryBytes[len(entryBytes)-32:], f.now())
 
-	//update FATs
-	numberOfFats := getValue(f.File, offsetObject{BootSector.FatCopies.Offset, BootSector.FatCopies.Length})
-	for i := int64(0); i < numberOfFats; i++ {
-		err := writeBytes(f.File, []byte{0xFF, 0xFF}, (f.CommonSizes.SectorsPerFat*i)+fatEntry)
+	//write name entry to its slots, which may span clusters
+	for i, o := range slots {
+		err = f.writeEntryBytes(entryBytes[i*32:(i+1)*32], o)
 		if err != nil {
-			return -1, err
+			f.freeChain(chain)
+			return -1, nil, err
 		}
 	}
 
-	return (entryOffset + (int64(entries)-1)*32), nil
+	return slots[len(slots)-1], chain, nil
 
 	/*
 
@@ -646,14 +542,10 @@ func (f *fat16) clearCluster(clusterNumber int64) error {
 	if offset == -1 {
 		return errors.New("could not find cluster " + strconv.FormatInt(clusterNumber, 16))
 	}
-	//clear each entry (can probably optimize this)
-	for i := int64(0); i < f.CommonSizes.BytesPerCluster; i++ {
-		if getValue(f.File, offsetObject{offset + i, 1}) != 0x00 {
-			err := writeBytes(f.File, []byte{0x00}, offset+i)
-			if err != nil {
-				return err
-			}
-		}
+	//clear the whole cluster in one write
+	err := writeBytes(f.dev, make([]byte, f.CommonSizes.BytesPerCluster), offset)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -662,18 +554,18 @@ func (f *fat16) clearCluster(clusterNumber int64) error {
 //read file name from a given offset
 func (f *fat16) readName(offset int64) string {
 	//check if entry is free or deleted
-	b, _ := readBytes(f.File, offset, 1, false)
+	b, _ := readBytes(f.dev, offset, 1, false)
 	if b[0] == 0x00 || b[0] == 0xE5 {
 		return ""
 	}
 
 	isLFNOffset := 0x0B
-	b, _ = readBytes(f.File, offset+int64(isLFNOffset), 1, false)
+	b, _ = readBytes(f.dev, offset+int64(isLFNOffset), 1, false)
 	isLFN := b[0] == byte(0x0F)
 
 	//Is LFN
 	if isLFN {
-		temp, _ := readBytes(f.File, offset, 1, false)
+		temp, _ := readBytes(f.dev, offset, 1, false)
 		lfnChainLength := temp[0] & 0x3F
 
 		fileNameReversed := ""
@@ -684,7 +576,7 @@ func (f *fat16) readName(offset int64) string {
 			for _, o := range unicodeOffsets {
 				p := o + offset + int64(i*32)
 
-				t, _ := readBytes(f.File, p, 2, true)
+				t, _ := readBytes(f.dev, p, 2, true)
 
 				j := btoi64(&t)
 				if j == 0x0000 || j == 0xffff {
@@ -705,7 +597,7 @@ func (f *fat16) readName(offset int64) string {
 	} else {
 		//Is not LFN
 		//read file name
-		byteArrayName, _ := readBytes(f.File, offset, 8, false)
+		byteArrayName, _ := readBytes(f.dev, offset, 8, false)
 		fileNameBytes := make([]byte, 0)
 
 		for j := range byteArrayName {
@@ -717,7 +609,7 @@ func (f *fat16) readName(offset int64) string {
 			}
 		}
 		//read file extension
-		byteArrayExt, _ := readBytes(f.File, offset+8, 3, false)
+		byteArrayExt, _ := readBytes(f.dev, offset+8, 3, false)
 		fileExtBytes := make([]byte, 0)
 
 		for j := range byteArrayExt {
@@ -738,14 +630,14 @@ func (f *fat16) readName(offset int64) string {
 	return ""
 }
 
-//create fileSystemOffsetStructure for a given file in HEX offsets
-func getRegionData(file *os.File) fileSystemOffsetStruct {
-	bytesPerSector := getValue(file, BootSector.BytesPerSector)
-	sectorsPerFat := getValue(file, BootSector.SectorsPerFat)
-	numberOfFats := getValue(file, BootSector.FatCopies)
-	rootEntriesCount := getValue(file, BootSector.RootEntries)
-	reservedSectorsCount := getValue(file, BootSector.ReservedSectors)
-	totalNumberOfSectors := getValue(file, BootSector.SmallSectors) + getValue(file, BootSector.LargeSectors)
+//create fileSystemOffsetStructure for a given BPB in HEX offsets
+func getRegionData(bpb BootParameterBlock) fileSystemOffsetStruct {
+	bytesPerSector := int64(bpb.BytesPerSector)
+	sectorsPerFat := int64(bpb.SectorsPerFat)
+	numberOfFats := int64(bpb.FatCopies)
+	rootEntriesCount := int64(bpb.RootEntries)
+	reservedSectorsCount := int64(bpb.ReservedSectors)
+	totalNumberOfSectors := bpb.TotalSectors()
 
 	//values for return struct
 	reservedRegionStart := VOLUME_START
@@ -768,6 +660,47 @@ func getRegionData(file *os.File) fileSystemOffsetStruct {
 	}
 }
 
+//give the short entry ending entryBytes a ~n tail if its alias is taken, the base cut so the tail fits in 8 characters as dosfsck does
+func setFreeAlias(entryBytes []byte, taken func(string) bool) error {
+	short := entryBytes[len(entryBytes)-32:]
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:11]), " ")
+	if ext != "" {
+		ext = "." + ext
+	}
+	if !taken(base + ext) {
+		return nil
+	}
+	//without long name entries the alias is the name
+	if len(entryBytes) == 32 {
+		return errors.New("entry with this name already exists")
+	}
+	for n := 1; n <= 999999; n++ {
+		tail := "~" + strconv.Itoa(n)
+		cut := base
+		if len(cut) > 8-len(tail) {
+			cut = cut[:8-len(tail)]
+		}
+		if !taken(cut + tail + ext) {
+			copy(short[:8], []byte(cut+tail+"        "))
+			setLfnChecksum(entryBytes)
+			return nil
+		}
+	}
+	return errors.New("no free short name left for " + base + ext)
+}
+
+//update the checksum of every LFN entry in an entry run to match its short entry
+func setLfnChecksum(entryBytes []byte) {
+	shortOffset := len(entryBytes) - 32
+	cSum := generateLfnChecksum(string(entryBytes[shortOffset : shortOffset+11]))
+	for i := 0; i < shortOffset; i += 32 {
+		if entryBytes[i+0x0B] == 0x0F {
+			entryBytes[i+0x0D] = cSum
+		}
+	}
+}
+
 //generate LFN name checksum
 func generateLfnChecksum(sfn string) byte {
 	checksum := byte(0)
@@ -783,29 +716,13 @@ func generateLfnChecksum(sfn string) byte {
 
 //return the offset value for item in path, return -1 if path is not found
 func (f *fat16) getPathOffset(path string) (int64, error) {
-	//split path
-	pathSegments := strings.Split(path, "/")
-	workingOffset := f.CurrentDirOffset
-	//path is from root
-	if pathSegments[0] == "" {
-		workingOffset = f.RegionOffsets.RootDirRegion.Offset
-		pathSegments = pathSegments[1:]
-	}
-	returnOffset := workingOffset
-	dirEntryOffset := workingOffset
-	//go through every path segment
-	for _, p := range pathSegments {
-		if p == "" {
-			continue
-		}
-
-		//get offset of given file
-		dirEntryOffset = f.findOffset(dirEntryOffset, p)
-		if dirEntryOffset == -1 {
-			return -1, errors.New(path + " is not a valid path")
-		}
-		returnOffset = dirEntryOffset
+	entry, err := f.lookup(path)
+	if err != nil {
+		return -1, err
 	}
-
-	return returnOffset, nil
+	//the root directory has no entry of its own
+	if entry.Offset == -1 {
+		return f.RegionOffsets.RootDirRegion.Offset, nil
+	}
+	return entry.Offset, nil
 }
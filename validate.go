@@ -0,0 +1,109 @@
+package lipid
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//returned (wrapped) when the image does not hold a usable FAT16 filesystem
+var ErrCorrupt = errors.New("corrupt filesystem")
+
+//read, parse and check the boot sector of an image
+func readBootSector(file *os.File) (BootParameterBlock, error) {
+	stats, err := file.Stat()
+	if err != nil {
+		return BootParameterBlock{}, err
+	}
+	fileSize := stats.Size()
+	if fileSize < 512 {
+		return BootParameterBlock{}, fmt.Errorf("%w: image is %d bytes, smaller than a boot sector", ErrCorrupt, fileSize)
+	}
+	raw, err := readBytes(file, VOLUME_START, 512, false)
+	if err != nil {
+		return BootParameterBlock{}, err
+	}
+	bpb := parseBootSector(raw)
+	return bpb, validateBootSector(file, bpb, fileSize)
+}
+
+//check the BPB of an image, listing every problem found
+func validateBootSector(file *os.File, bpb BootParameterBlock, fileSize int64) error {
+	problems := make([]string, 0)
+
+	if bpb.BootSectorSig != 0xAA55 {
+		problems = append(problems, "missing boot sector signature 0x55AA")
+	}
+
+	bytesPerSector := int64(bpb.BytesPerSector)
+	if !(bytesPerSector == 512 || bytesPerSector == 1024 || bytesPerSector == 2048 || bytesPerSector == 4096) {
+		problems = append(problems, "invalid bytes per sector "+strconv.FormatInt(bytesPerSector, 10))
+	}
+
+	sectorsPerCluster := int64(bpb.SectorsPerCluster)
+	if sectorsPerCluster == 0 || sectorsPerCluster > 128 || sectorsPerCluster&(sectorsPerCluster-1) != 0 {
+		problems = append(problems, "invalid sectors per cluster "+strconv.FormatInt(sectorsPerCluster, 10))
+	}
+
+	if bpb.ReservedSectors == 0 {
+		problems = append(problems, "reserved sector count is 0")
+	}
+	if bpb.FatCopies == 0 {
+		problems = append(problems, "FAT count is 0")
+	}
+	sectorsPerFat := int64(bpb.SectorsPerFat)
+	if sectorsPerFat == 0 {
+		problems = append(problems, "sectors per FAT is 0")
+	}
+	if bpb.RootEntries == 0 {
+		problems = append(problems, "root entry count is 0")
+	}
+	totalSectors := bpb.TotalSectors()
+	if totalSectors == 0 {
+		problems = append(problems, "total sector count is 0")
+	}
+
+	mediaDescriptor := int64(bpb.MediaDescriptor)
+	if !(mediaDescriptor == 0xF0 || mediaDescriptor >= 0xF8) {
+		problems = append(problems, "invalid media descriptor 0x"+strconv.FormatInt(mediaDescriptor, 16))
+	}
+
+	//region layout is meaningless without a valid geometry
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+
+	regions := getRegionData(bpb)
+	if regions.FATRegion.Offset+regions.FATRegion.Length > fileSize {
+		problems = append(problems, "FAT region ends past end of image")
+	}
+	if regions.RootDirRegion.Offset+regions.RootDirRegion.Length > fileSize {
+		problems = append(problems, "root directory region ends past end of image")
+	}
+	if regions.DataRegion.Length <= 0 {
+		problems = append(problems, "data region is empty")
+	} else if regions.DataRegion.Offset+regions.DataRegion.Length > fileSize {
+		problems = append(problems, "data region ends past end of image ("+strconv.FormatInt(totalSectors*bytesPerSector, 10)+" bytes needed, image is "+strconv.FormatInt(fileSize, 10)+")")
+	} else {
+		//every cluster in the data region needs a FAT entry
+		clusterCount := regions.DataRegion.Length / (bytesPerSector * sectorsPerCluster)
+		if (clusterCount+2)*2 > sectorsPerFat*bytesPerSector {
+			problems = append(problems, "FAT is too small for "+strconv.FormatInt(clusterCount, 10)+" clusters")
+		}
+	}
+
+	//FAT[0] holds the media descriptor in its low byte
+	if regions.FATRegion.Offset+2 <= fileSize {
+		fatID := getValue(file, offsetObject{regions.FATRegion.Offset, 2})
+		if fatID != 0xFF00|mediaDescriptor {
+			problems = append(problems, "FAT[0] 0x"+strconv.FormatInt(fatID, 16)+" does not match media descriptor 0x"+strconv.FormatInt(mediaDescriptor, 16))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package lipid
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+//attribute bits of a directory entry
+const (
+	AttrReadOnly    byte = 0x01
+	AttrHidden      byte = 0x02
+	AttrSystem      byte = 0x04
+	AttrVolumeLabel byte = 0x08
+	AttrDirectory   byte = 0x10
+	AttrArchive     byte = 0x20
+)
+
+//metadata of a directory entry
+type EntryInfo struct {
+	Path         string //path of the entry, starting from the root passed to the walk
+	Name         string //long name if present, short name otherwise
+	ShortName    string
+	Attr         byte
+	StartCluster int64
+	Size         int64
+	Created      time.Time
+	Modified     time.Time
+	Accessed     time.Time //date only
+	Deleted      bool
+	Offset       int64 //offset of the short entry in the image, -1 for the root directory
+}
+
+func (e EntryInfo) IsDir() bool { return e.Attr&AttrDirectory != 0 && !e.IsVolumeLabel() }
+
+func (e EntryInfo) IsVolumeLabel() bool { return e.Attr&AttrVolumeLabel != 0 }
+
+//returned by a WalkFunc to skip the rest of a directory; on a file it skips the file's remaining siblings
+var SkipDir = errors.New("skip this directory")
+
+//returned by a WalkFunc to end the walk
+var SkipAll = errors.New("skip everything and stop the walk")
+
+//called for every entry of a walk; err is set, with the directory's entry, if a directory could not be read
+type WalkFunc func(path string, entry EntryInfo, err error) error
+
+//what a walk visits and in which order
+type WalkOptions struct {
+	Sorted         bool //visit entries sorted by name ignoring case instead of in directory order
+	IncludeDeleted bool //also visit deleted entries, their directories are not entered
+	IncludeLabels  bool //also visit volume label entries
+}
+
+//visit every entry under root depth-first in directory order, root included; '.' and '..' are never visited
+func (f *fat16) Walk(root string, fn WalkFunc) error {
+	return f.WalkDir(root, WalkOptions{}, fn)
+}
+
+//visit every entry under root depth-first, root included; '.' and '..' are never visited
+func (f *fat16) WalkDir(root string, opts WalkOptions, fn WalkFunc) error {
+	entry, err := f.lookup(root)
+	if err != nil {
+		err = fn(root, EntryInfo{Path: root, Offset: -1}, err)
+	} else {
+		err = f.walk(root, entry, opts, fn, make(map[int64]bool))
+	}
+	if err == SkipDir || err == SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (f *fat16) walk(path string, entry dirEntry, opts WalkOptions, fn WalkFunc, visited map[int64]bool) error {
+	info := entryInfo(path, entry)
+	err := fn(path, info, nil)
+	if err != nil || !info.IsDir() || info.Deleted {
+		if err == SkipDir && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	err = checkDirLoop(visited, entry.Start)
+	var entries []dirEntry
+	if err == nil {
+		entries, err = f.readDirEntries(entry.Start, opts.IncludeDeleted, opts.IncludeLabels)
+	}
+	if err != nil {
+		err = fn(path, info, err)
+		if err == SkipDir {
+			return nil
+		}
+		return err
+	}
+	if opts.Sorted {
+		sort.SliceStable(entries, func(i, j int) bool {
+			a, b := strings.ToLower(entries[i].Name), strings.ToLower(entries[j].Name)
+			if a == b {
+				return entries[i].Name < entries[j].Name
+			}
+			return a < b
+		})
+	}
+
+	for _, e := range entries {
+		if e.IsDot() {
+			continue
+		}
+		err := f.walk(joinPath(path, e.Name), e, opts, fn, visited)
+		if err == SkipDir {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//metadata of a parsed entry
+func entryInfo(path string, e dirEntry) EntryInfo {
+	info := EntryInfo{
+		Path:         path,
+		Name:         e.Name,
+		ShortName:    e.ShortName,
+		Attr:         e.Attr,
+		StartCluster: e.Start,
+		Size:         e.Size,
+		Deleted:      e.Deleted,
+		Offset:       e.Offset,
+	}
+	if len(e.Raw) == 32 {
+		r := e.Raw
+		info.Created = fatTime(uint16(r[0x10])|uint16(r[0x11])<<8, uint16(r[0x0E])|uint16(r[0x0F])<<8, r[0x0D])
+		info.Accessed = fatTime(uint16(r[0x12])|uint16(r[0x13])<<8, 0, 0)
+		info.Modified = fatTime(uint16(r[0x18])|uint16(r[0x19])<<8, uint16(r[0x16])|uint16(r[0x17])<<8, 0)
+	}
+	return info
+}
+
+//path of name inside the directory at dir
+func joinPath(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}